@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// affinity keeps clients on the server they were last sent to for ttl after
+// their last connection, for as long as the server's still in rotation.
+type affinity struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	clients map[string]stickySession
+}
+
+type stickySession struct {
+	Client  string    `json:"client"`
+	Server  string    `json:"server"`
+	Group   string    `json:"group"`
+	Expires time.Time `json:"expires"`
+}
+
+func newAffinity(ttl time.Duration) *affinity {
+	a := &affinity{
+		ttl:     ttl,
+		clients: map[string]stickySession{},
+	}
+
+	if ttl > 0 {
+		go a.prune()
+	}
+	return a
+}
+
+// lookup returns the backend a client is stuck to, if it's one of the
+// backends being picked from.
+func (a *affinity) lookup(ip string, backends []backend) (backend, bool) {
+	if a.ttl <= 0 {
+		return backend{}, false
+	}
+
+	a.mu.Lock()
+	session, ok := a.clients[ip]
+	a.mu.Unlock()
+
+	if !ok || time.Now().After(session.Expires) {
+		return backend{}, false
+	}
+
+	for _, b := range backends {
+		if b.group == session.Group && b.server == session.Server {
+			return b, true
+		}
+	}
+	return backend{}, false
+}
+
+// stick records the backend a client was sent to.
+func (a *affinity) stick(ip string, b backend) {
+	if a.ttl <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.clients[ip] = stickySession{
+		Client:  ip,
+		Server:  b.server,
+		Group:   b.group,
+		Expires: time.Now().Add(a.ttl),
+	}
+}
+
+// flush removes a client's session, or every session if client is empty,
+// returning the number removed.
+func (a *affinity) flush(client string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if client != "" {
+		if _, ok := a.clients[client]; !ok {
+			return 0
+		}
+		delete(a.clients, client)
+		return 1
+	}
+
+	n := len(a.clients)
+	a.clients = map[string]stickySession{}
+	return n
+}
+
+func (a *affinity) prune() {
+	ticker := time.NewTicker(a.ttl)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		a.mu.Lock()
+		for ip, session := range a.clients {
+			if now.After(session.Expires) {
+				delete(a.clients, ip)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (svr *server) handleGetAffinity(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetAffinity")
+	defer log.Println("[END] handleGetAffinity")
+
+	p, err := parsePage(r)
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	now := time.Now()
+
+	a := svr.affinity
+	a.mu.Lock()
+	sessions := []stickySession{}
+	for ip, session := range a.clients {
+		if p.matches(ip) && now.Before(session.Expires) {
+			sessions = append(sessions, session)
+		}
+	}
+	a.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Client < sessions[j].Client
+	})
+
+	return errhandler.SendJSON(w, paginate(w, p, sessions))
+}
+
+type flushAffinityResponse struct {
+	Flushed int `json:"flushed"`
+}
+
+// handleFlushAffinity forgets which servers clients are stuck to, for a
+// single client if ?client= is given.
+func (svr *server) handleFlushAffinity(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleFlushAffinity")
+	defer log.Println("[END] handleFlushAffinity")
+
+	client := r.URL.Query().Get("client")
+	flushed := svr.affinity.flush(client)
+
+	log.Printf("[FLUSH] affinity: client: %q flushed: %d", client, flushed)
+
+	return errhandler.SendJSON(w, flushAffinityResponse{Flushed: flushed})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// annotationsResponse describes what a dp instance is for (its owner, a
+// ticket, its purpose), which helps on shared instances.
+type annotationsResponse struct {
+	Port        int               `json:"port"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type setAnnotationRequest struct {
+	Value string `json:"value"`
+}
+
+// parseAnnotation parses a key=value annotation given on the command line.
+func parseAnnotation(annotations map[string]string) func(string) error {
+	return func(s string) error {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("invalid annotation %q, must be key=value", s)
+		}
+
+		annotations[key] = value
+		return nil
+	}
+}
+
+func (svr *server) handleGetAnnotations(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetAnnotations")
+	defer log.Println("[END] handleGetAnnotations")
+
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	return errhandler.SendJSON(w, annotationsResponse{
+		Port:        svr.port,
+		Annotations: svr.annotations,
+	})
+}
+
+func (svr *server) handleSetAnnotation(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSetAnnotation")
+	defer log.Println("[END] handleSetAnnotation")
+
+	key := r.PathValue("key")
+
+	var req setAnnotationRequest
+	if err := errhandler.ParseJSON(r, &req); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	log.Printf("[SET] annotation: %q value: %q", key, req.Value)
+
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	svr.annotations[key] = req.Value
+	return nil
+}
+
+func (svr *server) handleDeleteAnnotation(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleDeleteAnnotation")
+	defer log.Println("[END] handleDeleteAnnotation")
+
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	delete(svr.annotations, r.PathValue("key"))
+	return nil
+}
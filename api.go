@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// apiVersion prefixes every control API route. Unversioned routes are kept
+// as deprecated aliases for one release, so existing scripts keep working
+// while they move over.
+const apiVersion = "/v1"
+
+// versionedRoutes returns a function that registers a "METHOD /path" pattern
+// under the current API version, along with its deprecated unversioned
+// alias.
+func versionedRoutes(m *http.ServeMux) func(pattern string, h http.Handler) {
+	return func(pattern string, h http.Handler) {
+		method, path, _ := strings.Cut(pattern, " ")
+
+		m.Handle(method+" "+apiVersion+path, h)
+		m.Handle(pattern, deprecated(h))
+	}
+}
+
+// deprecated marks responses from unversioned routes as deprecated, pointing
+// clients at the versioned route.
+func deprecated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[%s] deprecated unversioned route %s %s, use %s%s", requestID(r), r.Method, r.URL.Path, apiVersion, r.URL.Path)
+
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiVersion+r.URL.Path+`>; rel="successor-version"`)
+		h.ServeHTTP(w, r)
+	})
+}
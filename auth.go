@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const jwksRefreshInterval = time.Minute
+
+type role int
+
+const (
+	roleViewer role = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+var roles = map[string]role{
+	"viewer":   roleViewer,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+type claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// authenticator verifies bearer tokens on control API requests, signed
+// either with a shared HMAC secret or by a key published at a JWKS URL.
+type authenticator struct {
+	secret  []byte
+	jwksURL string
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	lastRefresh time.Time
+}
+
+func newAuthenticator(secret, jwksURL string) *authenticator {
+	if secret == "" && jwksURL == "" {
+		return nil
+	}
+
+	return &authenticator{
+		secret:  []byte(secret),
+		jwksURL: jwksURL,
+		keys:    map[string]*rsa.PublicKey{},
+	}
+}
+
+// authorize returns middleware that rejects requests whose token doesn't
+// grant at least the given role. Everything is allowed when authentication
+// isn't configured.
+func (svr *server) authorize(min role) errhandler.Middleware {
+	return func(next errhandler.Wrap) errhandler.Wrap {
+		if svr.auth == nil {
+			return next
+		}
+
+		return func(w http.ResponseWriter, r *http.Request) error {
+			got, err := svr.auth.role(r)
+			if err != nil {
+				return errhandler.Error(http.StatusUnauthorized, err)
+			}
+
+			if got < min {
+				return errhandler.Error(http.StatusForbidden, errors.New("insufficient role"))
+			}
+
+			return next(w, r)
+		}
+	}
+}
+
+func (a *authenticator) role(r *http.Request) (role, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return 0, errors.New("missing bearer token")
+	}
+
+	var c claims
+	if _, err := jwt.ParseWithClaims(raw, &c, a.key); err != nil {
+		return 0, fmt.Errorf("invalid token: %w", err)
+	}
+
+	found, ok := roles[c.Role]
+	if !ok {
+		return 0, fmt.Errorf("unknown role %q", c.Role)
+	}
+
+	return found, nil
+}
+
+func (a *authenticator) key(token *jwt.Token) (any, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(a.secret) == 0 {
+			return nil, errors.New("hmac tokens not accepted")
+		}
+		return a.secret, nil
+
+	case *jwt.SigningMethodRSA:
+		if a.jwksURL == "" {
+			return nil, errors.New("rsa tokens not accepted")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return a.jwksKey(kid)
+
+	default:
+		return nil, fmt.Errorf("unsupported signing method %q", token.Method.Alg())
+	}
+}
+
+// jwksKey returns the key with the given id, refreshing the key set if the
+// key is unknown and it hasn't been refreshed recently.
+func (a *authenticator) jwksKey(kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(a.lastRefresh) > jwksRefreshInterval {
+		a.lastRefresh = time.Now()
+
+		keys, err := fetchJWKS(a.jwksURL)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, error) {
+	client := http.Client{Timeout: time.Second * 10}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching jwks: %s", resp.Status)
+	}
+
+	var set jwks
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("parsing jwks: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("parsing jwks key %q modulus: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("parsing jwks key %q exponent: %w", k.Kid, err)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
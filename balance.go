@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/samber/lo"
+)
+
+const (
+	balanceRandom     = "random"
+	balanceRoundRobin = "round_robin"
+	balanceHash       = "hash"
+)
+
+// validateBalance checks a group's balancing mode is one dp supports.
+func validateBalance(balance string) error {
+	switch balance {
+	case "", balanceRandom, balanceRoundRobin, balanceHash:
+		return nil
+	default:
+		return fmt.Errorf("invalid balance %q, must be %q, %q or %q", balance, balanceRandom, balanceRoundRobin, balanceHash)
+	}
+}
+
+// balancer picks which of a group's servers a client is sent to.
+type balancer interface {
+	pick(group, ip string, backends []backend) backend
+}
+
+// newBalancers returns a balancer for every balancing mode, by name.
+func newBalancers() map[string]balancer {
+	random := randomBalancer{}
+
+	return map[string]balancer{
+		"":                random,
+		balanceRandom:     random,
+		balanceRoundRobin: newRoundRobin(),
+		balanceHash:       hashBalancer{},
+	}
+}
+
+// randomBalancer picks any of a group's servers.
+type randomBalancer struct{}
+
+func (randomBalancer) pick(_, _ string, backends []backend) backend {
+	return lo.Sample(backends)
+}
+
+// roundRobin hands out each group's servers in turn.
+type roundRobin struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func newRoundRobin() *roundRobin {
+	return &roundRobin{next: map[string]int{}}
+}
+
+func (rr *roundRobin) pick(group, _ string, backends []backend) backend {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	i := rr.next[group] % len(backends)
+	rr.next[group] = i + 1
+
+	return backends[i]
+}
+
+// hashBalancer maps a client IP to one of a group's servers using
+// rendezvous hashing, so the client gets the same server each time, and
+// only clients of a server that's removed are moved elsewhere. Only the
+// server is hashed, so a client sticks to a server whichever group it's in.
+// A server in more than one group in rotation (or a hash collision) scores
+// the same, so ties go to the lowest group and server, whatever order the
+// backends are in.
+type hashBalancer struct{}
+
+func (hashBalancer) pick(_, ip string, backends []backend) backend {
+	var picked backend
+	var highest uint64
+
+	for i, b := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(ip))
+		h.Write([]byte{0})
+		h.Write([]byte(b.server))
+
+		score := h.Sum64()
+		if i == 0 || score > highest || (score == highest && hashTieBefore(b, picked)) {
+			picked, highest = b, score
+		}
+	}
+
+	return picked
+}
+
+func hashTieBefore(a, b backend) bool {
+	if a.group != b.group {
+		return a.group < b.group
+	}
+	return a.server < b.server
+}
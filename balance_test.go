@@ -0,0 +1,28 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHashBalancerTiesIgnoreOrder(t *testing.T) {
+	backends := []backend{
+		{group: "green", server: "shared:26257"},
+		{group: "blue", server: "shared:26257"},
+		{group: "blue", server: "other:26257"},
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "192.168.1.23"} {
+		want := hashBalancer{}.pick("", ip, backends)
+
+		reversed := slices.Clone(backends)
+		slices.Reverse(reversed)
+		if got := (hashBalancer{}).pick("", ip, reversed); got != want {
+			t.Fatalf("%s: picked %s/%s, then %s/%s with the backends reversed", ip, want.group, want.server, got.group, got.server)
+		}
+
+		if want.server == "shared:26257" && want.group != "blue" {
+			t.Fatalf("%s: tie went to %s rather than blue", ip, want.group)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"log"
+	"os"
+)
+
+func runBind(args []string) {
+	// Dropping privileges to another user is a unix concept.
+	log.Printf("dp bind isn't supported on this platform")
+	os.Exit(exitConfigError)
+}
+
+func privilegedPortHint(err error) error {
+	return err
+}
@@ -0,0 +1,156 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runBind binds the proxy port (and optionally the control port), which may
+// be privileged, then starts dp as an unprivileged user with the sockets
+// passed down to it, so dp itself never runs as root.
+func runBind(args []string) {
+	fs := flag.NewFlagSet("bind", flag.ExitOnError)
+	username := fs.String("user", "", "user to run dp as")
+	addr := fs.String("addr", "localhost", "address to bind the proxy port to (empty for all interfaces)")
+	port := fs.Int("port", 443, "port number for proxy requests")
+	ctlAddr := fs.String("ctl-addr", "localhost", "address to bind the control port to (empty for all interfaces)")
+	ctlPort := fs.Int("ctl-port", 0, "port number for proxy control requests (0 to leave it to dp)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dp bind -user USER [flags] [-- dp flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *username == "" {
+		log.Printf("-user is required")
+		os.Exit(exitBadFlags)
+	}
+
+	cred, err := lookupCredential(*username)
+	if err != nil {
+		log.Printf("error looking up user: %v", err)
+		os.Exit(exitConfigError)
+	}
+
+	names := []string{listenerProxy}
+	sockets := []string{net.JoinHostPort(*addr, strconv.Itoa(*port))}
+	childArgs := []string{"-port", strconv.Itoa(*port)}
+	if *ctlPort != 0 {
+		names = append(names, listenerControl)
+		sockets = append(sockets, net.JoinHostPort(*ctlAddr, strconv.Itoa(*ctlPort)))
+		childArgs = append(childArgs, "-ctl-port", strconv.Itoa(*ctlPort))
+	}
+
+	var files []*os.File
+	for i, socket := range sockets {
+		f, err := bindFile(socket)
+		if err != nil {
+			log.Printf("error binding %s port: %v", names[i], err)
+			os.Exit(exitBindFailure)
+		}
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("error finding dp executable: %v", err)
+		os.Exit(exitConfigError)
+	}
+
+	cmd := exec.Command(exe, append(childArgs, fs.Args()...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), inheritedFDsEnv+"="+strings.Join(names, ":"))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+
+	// The parent ignores these and leaves the child to shut itself down,
+	// forwarding them in case they weren't sent to the whole process group.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	if err = cmd.Start(); err != nil {
+		log.Printf("error starting dp: %v", err)
+		os.Exit(exitConfigError)
+	}
+
+	// The child has its own copies of the sockets now.
+	for _, f := range files {
+		f.Close()
+	}
+
+	log.Printf("bound %s, running dp as %s (pid %d)", strings.Join(sockets, " and "), *username, cmd.Process.Pid)
+
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		log.Printf("error running dp: %v", err)
+		os.Exit(exitServeError)
+	}
+}
+
+func lookupCredential(username string) (*syscall.Credential, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %q: %w", u.Uid, err)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %q: %w", u.Gid, err)
+	}
+
+	if uid == 0 {
+		return nil, fmt.Errorf("%s is root, which defeats the point of dp bind", username)
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
+
+// bindFile listens on a TCP address and returns the listening socket's file,
+// ready to be passed to a child process.
+func bindFile(addr string) (*os.File, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	return l.(*net.TCPListener).File()
+}
+
+// privilegedPortHint explains how to bind a privileged port if binding one
+// was refused.
+func privilegedPortHint(err error) error {
+	if !errors.Is(err, syscall.EACCES) {
+		return err
+	}
+
+	return fmt.Errorf("%w (binding ports below 1024 needs privileges: start dp with dp bind, or run sudo setcap cap_net_bind_service=+ep on the dp binary)", err)
+}
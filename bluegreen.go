@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// blueGreen maps the live and standby roles to groups, so switching between
+// them is a swap rather than an activation naming the groups.
+type blueGreen struct {
+	Live    string `json:"live"`
+	Standby string `json:"standby"`
+}
+
+type blueGreenResponse struct {
+	blueGreen
+	Servers []string `json:"servers"`
+}
+
+func (svr *server) handleGetBlueGreen(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetBlueGreen")
+	defer log.Println("[END] handleGetBlueGreen")
+
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	if svr.blueGreen == nil {
+		return errhandler.Error(http.StatusNotFound, errors.New("blue/green roles not set"))
+	}
+
+	return errhandler.SendJSON(w, svr.blueGreenResponse())
+}
+
+func (svr *server) handleSetBlueGreen(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSetBlueGreen")
+	defer log.Println("[END] handleSetBlueGreen")
+
+	var req blueGreen
+	if err := errhandler.ParseJSON(r, &req); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	if req.Live == req.Standby {
+		return errhandler.Error(http.StatusUnprocessableEntity, errors.New("live and standby must be different groups"))
+	}
+
+	svr.serversMu.Lock()
+
+	for _, g := range []string{req.Live, req.Standby} {
+		if _, ok := svr.serverGroups[g]; !ok {
+			svr.serversMu.Unlock()
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("group %q not found", g))
+		}
+	}
+
+	log.Printf("[SET] live: %q standby: %q", req.Live, req.Standby)
+
+	// Connections are only terminated if the live group changes, so
+	// re-sending the roles or changing the standby leaves them be.
+	changed := !svr.onlyActive(req.Live)
+
+	svr.blueGreen = &req
+	if changed {
+		svr.activateGroups([]string{req.Live})
+	}
+	resp := svr.blueGreenResponse()
+
+	svr.serversMu.Unlock()
+
+	if changed {
+		svr.terminate()
+	}
+
+	return errhandler.SendJSON(w, resp)
+}
+
+// onlyActive returns whether group is the only active group. The caller
+// must hold serversMu.
+func (svr *server) onlyActive(group string) bool {
+	for name, g := range svr.serverGroups {
+		if g.Active != (name == group) {
+			return false
+		}
+	}
+	return true
+}
+
+func (svr *server) handleSwapBlueGreen(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSwapBlueGreen")
+	defer log.Println("[END] handleSwapBlueGreen")
+
+	svr.serversMu.Lock()
+
+	if svr.blueGreen == nil {
+		svr.serversMu.Unlock()
+		return errhandler.Error(http.StatusNotFound, errors.New("blue/green roles not set"))
+	}
+
+	svr.blueGreen.Live, svr.blueGreen.Standby = svr.blueGreen.Standby, svr.blueGreen.Live
+	log.Printf("[SWAP] live: %q standby: %q", svr.blueGreen.Live, svr.blueGreen.Standby)
+
+	svr.activateGroups([]string{svr.blueGreen.Live})
+	resp := svr.blueGreenResponse()
+
+	svr.serversMu.Unlock()
+
+	svr.terminate()
+
+	return errhandler.SendJSON(w, resp)
+}
+
+// blueGreenResponse returns the current roles and the servers now live. The
+// caller must hold serversMu.
+func (svr *server) blueGreenResponse() blueGreenResponse {
+	return blueGreenResponse{
+		blueGreen: *svr.blueGreen,
+		Servers:   svr.serverGroups[svr.blueGreen.Live].Servers,
+	}
+}
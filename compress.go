@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	compressionDeflate = "deflate"
+	compressionNone    = "none"
+
+	// compressionTimeout is how long to wait for another dp instance to
+	// reply to a compression request before failing the dial.
+	compressionTimeout = time.Second * 2
+	maxCompressionAck  = 64
+)
+
+// validateCompression checks a group's compression is one dp supports.
+func validateCompression(compression string) error {
+	switch compression {
+	case "", compressionDeflate:
+		return nil
+	default:
+		return fmt.Errorf("invalid compression %q, must be %q", compression, compressionDeflate)
+	}
+}
+
+// compressedConn compresses everything written to it, flushing after each
+// write so nothing is held back waiting for more data.
+type compressedConn struct {
+	net.Conn
+	r io.Reader
+	w *flate.Writer
+}
+
+func newCompressedConn(conn net.Conn) (*compressedConn, error) {
+	w, err := flate.NewWriter(conn, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressedConn{Conn: conn, r: flate.NewReader(conn), w: w}, nil
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// CloseWrite ends the compressed stream, then half-closes the connection
+// underneath it.
+func (c *compressedConn) CloseWrite() error {
+	if err := c.w.Close(); err != nil {
+		return err
+	}
+	if !closeWrite(c.Conn) {
+		return errors.New("connection can't be half-closed")
+	}
+	return nil
+}
+
+// negotiateCompression asks the dp instance at the other end of a connection
+// to compress it. Compression is only for groups of dp instances: the
+// request has already been written by the time a server that isn't dp (or
+// dp without -preamble) fails to reply, corrupting its stream, so the dial
+// fails rather than carrying on. A dp instance that replies without
+// agreeing has consumed the request, so the connection carries on
+// uncompressed.
+func negotiateCompression(conn net.Conn, compression string) (net.Conn, error) {
+	if _, err := fmt.Fprintf(conn, "%scompress=%s\n", preambleMagic, compression); err != nil {
+		return nil, fmt.Errorf("requesting compression: %w", err)
+	}
+
+	br := bufio.NewReaderSize(conn, maxCompressionAck)
+	buffered := &bufferedConn{Conn: conn, r: br}
+
+	conn.SetReadDeadline(time.Now().Add(compressionTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for n := 1; n <= maxCompressionAck; n = br.Buffered() + 1 {
+		peeked, err := br.Peek(n)
+		if !bytes.HasPrefix([]byte(preambleMagic), peeked) && !bytes.HasPrefix(peeked, []byte(preambleMagic)) {
+			break
+		}
+
+		if i := bytes.IndexByte(peeked, '\n'); i >= 0 {
+			br.Discard(i + 1)
+
+			accepted := parsePreamble(string(peeked[:i])).compression
+			if accepted != compression {
+				log.Printf("server %s didn't accept %s compression, continuing uncompressed", conn.RemoteAddr(), compression)
+				return buffered, nil
+			}
+			return newCompressedConn(buffered)
+		}
+
+		if err != nil {
+			if isTimeout(err) {
+				break
+			}
+			return nil, fmt.Errorf("reading compression reply: %w", err)
+		}
+	}
+
+	return nil, fmt.Errorf("server %s didn't reply to compression request like a dp instance", conn.RemoteAddr())
+}
+
+// acceptCompression replies to another dp instance's compression request,
+// compressing the connection if the compression is supported.
+func acceptCompression(client net.Conn, compression string) (net.Conn, error) {
+	if validateCompression(compression) != nil {
+		compression = compressionNone
+	}
+
+	if _, err := fmt.Fprintf(client, "%scompress=%s\n", preambleMagic, compression); err != nil {
+		return nil, fmt.Errorf("accepting compression: %w", err)
+	}
+
+	if compression == compressionNone {
+		return client, nil
+	}
+	return newCompressedConn(client)
+}
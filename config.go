@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// serverConfig holds the settings a proxy server is built from, so dp and
+// soak runs build the same server.
+type serverConfig struct {
+	port    int
+	ctlPort int
+	debug   bool
+
+	staticDir        string
+	maxConnBytes     int64
+	maxClientBytes   int64
+	preflightTimeout time.Duration
+	jwtSecret        string
+	jwksURL          string
+	arbiterToken     string
+	ctlRate          float64
+	ctlMaxBody       int64
+	idempotencyTTL   time.Duration
+	terminateDelay   time.Duration
+	preamble         bool
+	peekLimits       peekLimits
+	statsRetention   time.Duration
+	statsSpill       string
+	annotations      map[string]string
+	onActivate       []string
+	routePlugin      string
+	dialTimeout      time.Duration
+	dialRetries      int
+	stuckAfter       time.Duration
+	resetStuck       bool
+	ejectAfter       int
+	ejectBackoff     time.Duration
+	affinityTTL      time.Duration
+	maxConns         int
+	connQueueTimeout time.Duration
+	backendPort      int
+}
+
+// defaultServerConfig returns the config dp runs with when it's given no
+// flags.
+func defaultServerConfig() serverConfig {
+	var c serverConfig
+	c.register(flag.NewFlagSet("dp", flag.ContinueOnError))
+	return c
+}
+
+// register defines the flags for the config's settings, each defaulting to
+// what dp runs with if it's not given.
+func (c *serverConfig) register(fs *flag.FlagSet) {
+	c.annotations = map[string]string{}
+
+	fs.IntVar(&c.port, "port", 26257, "port number for proxy requests")
+	fs.IntVar(&c.ctlPort, "ctl-port", 3000, "port number for proxy control requests")
+	fs.BoolVar(&c.debug, "debug", false, "enable debug-level logging")
+	fs.StringVar(&c.staticDir, "static", "", "directory to serve at /static on the control port")
+	fs.Int64Var(&c.maxConnBytes, "max-conn-bytes", 0, "maximum bytes a single connection can transfer before it's terminated (0 for no limit)")
+	fs.Int64Var(&c.maxClientBytes, "max-client-bytes", 0, "maximum bytes a client IP can transfer across all of its connections (0 for no limit)")
+	fs.DurationVar(&c.preflightTimeout, "preflight-timeout", time.Second*2, "dial timeout for activation preflight checks")
+	fs.StringVar(&c.jwtSecret, "jwt-secret", "", "shared secret for verifying HS256 control API tokens")
+	fs.StringVar(&c.arbiterToken, "arbiter-token", "", "bearer token sent to the failover arbiter, for arbiters that are other dp instances with auth enabled")
+	fs.StringVar(&c.jwksURL, "jwks-url", "", "JWKS URL for verifying RS256 control API tokens")
+	fs.Float64Var(&c.ctlRate, "ctl-rate", 10, "control API requests per second allowed per client IP (0 for no limit)")
+	fs.Int64Var(&c.ctlMaxBody, "ctl-max-body", 1<<20, "maximum control API request body size in bytes (0 for no limit)")
+	fs.DurationVar(&c.idempotencyTTL, "idempotency-ttl", time.Minute*10, "how long to replay responses for requests with an Idempotency-Key header")
+	fs.DurationVar(&c.terminateDelay, "terminate-delay", 0, "how long to wait after a change before terminating existing connections")
+	fs.BoolVar(&c.preamble, "preamble", false, "accept an optional \"DP1 tag=<tag>\" line at the start of client connections")
+	fs.IntVar(&c.peekLimits.maxBytes, "peek-max-bytes", 4096, "maximum bytes to buffer while looking at the start of a client connection")
+	fs.DurationVar(&c.peekLimits.timeout, "peek-timeout", time.Millisecond*100, "maximum time to wait while looking at the start of a client connection")
+	fs.DurationVar(&c.statsRetention, "stats-retention", time.Hour*24, "how long to keep traffic statistics rollups for")
+	fs.StringVar(&c.statsSpill, "stats-spill", "", "file to append expired traffic statistics rollups to")
+	fs.Func("annotation", "key=value annotation describing this instance (can be repeated)", parseAnnotation(c.annotations))
+	fs.Func("on-activate", "shell command to run when the active groups change, given DP_EVENT and DP_GROUPS (can be repeated)", func(s string) error {
+		c.onActivate = append(c.onActivate, s)
+		return nil
+	})
+	fs.StringVar(&c.routePlugin, "route-plugin", "", "long-running shell command to ask where each connection should go, over JSON lines on its stdin and stdout")
+	fs.DurationVar(&c.dialTimeout, "dial-timeout", time.Second*10, "how long to wait when dialing a server before giving up (0 for no timeout)")
+	fs.IntVar(&c.dialRetries, "dial-retries", 0, "how many more times to dial a server that fails before closing the client")
+	fs.DurationVar(&c.stuckAfter, "stuck-after", 0, "how long a server can go without responding to its client before the connection's flagged as stuck (0 to disable)")
+	fs.BoolVar(&c.resetStuck, "reset-stuck", false, "reset connections flagged as stuck")
+	fs.IntVar(&c.ejectAfter, "eject-after", 0, "consecutive failed dials before a server is ejected from rotation (0 to never eject)")
+	fs.DurationVar(&c.ejectBackoff, "eject-backoff", time.Second*5, "how long a server's first ejection lasts, doubling with each ejection after")
+	fs.DurationVar(&c.affinityTTL, "affinity-ttl", 0, "how long to keep sending a client to the same server after its last connection (0 to disable)")
+	fs.IntVar(&c.maxConns, "max-conns", 0, "maximum connections the proxy port serves at once (0 for no limit)")
+	fs.DurationVar(&c.connQueueTimeout, "conn-queue-timeout", 0, "how long connections over -max-conns wait for a free slot before they're closed (0 to close them straight away)")
+	fs.IntVar(&c.backendPort, "backend-port", 0, "port for servers given without one, if their group doesn't have a port")
+}
+
+func newServer(c serverConfig) *server {
+	return &server{
+		port:             c.port,
+		httpPort:         c.ctlPort,
+		connections:      newGauges(),
+		registry:         newRegistry(),
+		events:           newEventBus(),
+		serverGroups:     map[string]group{},
+		cordonedServers:  map[string]bool{},
+		latency:          newLatencyHistograms(),
+		stats:            newStats(c.statsRetention, c.statsSpill),
+		quotas:           newQuotas(c.maxConnBytes, c.maxClientBytes),
+		debug:            c.debug,
+		staticDir:        c.staticDir,
+		preflightTimeout: c.preflightTimeout,
+		auth:             newAuthenticator(c.jwtSecret, c.jwksURL),
+		ctlLimiter:       newClientLimiter(c.ctlRate, c.ctlMaxBody),
+		idempotency:      newIdempotencyCache(c.idempotencyTTL),
+		failover:         &failover{arbiterToken: c.arbiterToken},
+		preamble:         c.preamble,
+		peekLimits:       c.peekLimits,
+		tags:             map[string]tagPolicy{},
+		listener:         &listenerState{},
+		panics:           &panicCounters{},
+		hooks:            &activationHooks{commands: c.onActivate},
+		routePlugin:      newRoutePlugin(c.routePlugin),
+		health:           newHealthChecks(),
+		outliers:         newOutliers(c.ejectAfter, c.ejectBackoff),
+		dialTimeout:      c.dialTimeout,
+		dialRetries:      c.dialRetries,
+		stuckAfter:       c.stuckAfter,
+		resetStuck:       c.resetStuck,
+		balancers:        newBalancers(),
+		affinity:         newAffinity(c.affinityTTL),
+		protocols:        newProtocolCounts(),
+		connLimit:        newConnLimit(c.maxConns, c.connQueueTimeout),
+		backendPort:      c.backendPort,
+		annotations:      c.annotations,
+		tagConnections:   newGauges(),
+		pendingTermination: &pendingTermination{
+			delay: c.terminateDelay,
+		},
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// gauges tracks the number of open proxied connections per group (or tag).
+type gauges struct {
+	mu     sync.Mutex
+	groups map[string]int64
+}
+
+type connectionsResponse struct {
+	Port        int              `json:"port"`
+	Total       int64            `json:"total"`
+	Groups      map[string]int64 `json:"groups"`
+	Connections []connInfo       `json:"connections"`
+}
+
+// connInfo describes a single proxied connection. Its ID is attached to log
+// lines about the connection, so a session can be traced end to end.
+type connInfo struct {
+	ID      string    `json:"id"`
+	Client  string    `json:"client"`
+	Server  string    `json:"server"`
+	Group   string    `json:"group"`
+	Tag     string    `json:"tag,omitempty"`
+	Started time.Time `json:"started"`
+
+	// StuckSince is when the server stopped responding to the client, if
+	// the connection's been caught by the stuck connection watchdog.
+	StuckSince *time.Time `json:"stuck_since,omitempty"`
+}
+
+// registry holds every open proxied connection.
+type registry struct {
+	mu    sync.Mutex
+	conns map[string]connInfo
+}
+
+func newRegistry() *registry {
+	return &registry{
+		conns: map[string]connInfo{},
+	}
+}
+
+func (r *registry) add(info connInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conns[info.ID] = info
+}
+
+func (r *registry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, id)
+}
+
+// setStuck flags (or with nil, unflags) a connection as stuck.
+func (r *registry) setStuck(id string, since *time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if info, ok := r.conns[id]; ok {
+		info.StuckSince = since
+		r.conns[id] = info
+	}
+}
+
+func (r *registry) list() []connInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conns := make([]connInfo, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Started.Before(conns[j].Started)
+	})
+
+	return conns
+}
+
+func newConnID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newGauges() *gauges {
+	return &gauges{
+		groups: map[string]int64{},
+	}
+}
+
+func (g *gauges) inc(group string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.groups[group]++
+}
+
+// tryInc increments the gauge if it's below max, returning false if not.
+func (g *gauges) tryInc(key string, max int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if max > 0 && g.groups[key] >= max {
+		return false
+	}
+
+	g.groups[key]++
+	return true
+}
+
+func (g *gauges) dec(group string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.groups[group]--
+	if g.groups[group] <= 0 {
+		delete(g.groups, group)
+	}
+}
+
+func (g *gauges) snapshot() (int64, map[string]int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var total int64
+	groups := make(map[string]int64, len(g.groups))
+	for name, n := range g.groups {
+		groups[name] = n
+		total += n
+	}
+
+	return total, groups
+}
+
+// connectionOrder returns the ordering for a sort parameter, which names a
+// field to sort by, prefixed with "-" for descending order.
+func connectionOrder(field string) (func(a, b connInfo) bool, error) {
+	desc := strings.HasPrefix(field, "-")
+	field = strings.TrimPrefix(field, "-")
+
+	var less func(a, b connInfo) bool
+	switch field {
+	case "", "started":
+		less = func(a, b connInfo) bool { return a.Started.Before(b.Started) }
+	case "client":
+		less = func(a, b connInfo) bool { return a.Client < b.Client }
+	case "server":
+		less = func(a, b connInfo) bool { return a.Server < b.Server }
+	case "group":
+		less = func(a, b connInfo) bool { return a.Group < b.Group }
+	default:
+		return nil, fmt.Errorf("invalid sort %q, must be one of started, client, server or group", field)
+	}
+
+	if desc {
+		return func(a, b connInfo) bool { return less(b, a) }, nil
+	}
+	return less, nil
+}
+
+func (svr *server) handleGetConnections(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetConnections")
+	defer log.Println("[END] handleGetConnections")
+
+	p, err := parsePage(r)
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	q := r.URL.Query()
+	less, err := connectionOrder(q.Get("sort"))
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	stuck, err := parseBoolFilter(r, "stuck")
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	conns := []connInfo{}
+	for _, c := range svr.registry.list() {
+		if !p.matches(c.ID) {
+			continue
+		}
+		if v := q.Get("group"); v != "" && c.Group != v {
+			continue
+		}
+		if v := q.Get("server"); v != "" && c.Server != v {
+			continue
+		}
+		if v := q.Get("tag"); v != "" && c.Tag != v {
+			continue
+		}
+		if stuck != nil && (c.StuckSince != nil) != *stuck {
+			continue
+		}
+		conns = append(conns, c)
+	}
+
+	sort.SliceStable(conns, func(i, j int) bool {
+		return less(conns[i], conns[j])
+	})
+
+	total, groups := svr.connections.snapshot()
+
+	return errhandler.SendJSON(w, connectionsResponse{
+		Port:        svr.port,
+		Total:       total,
+		Groups:      groups,
+		Connections: paginate(w, p, conns),
+	})
+}
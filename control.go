@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// listenControl binds the control API to a unix socket if one's given, or
+// to the given address and port otherwise, retrying for up to retryFor if
+// the port is in use.
+func listenControl(addr string, port int, socket, mode string, retryFor time.Duration) (net.Listener, error) {
+	if socket == "" {
+		tcpAddr := net.JoinHostPort(addr, strconv.Itoa(port))
+		return bindWithRetry(tcpAddr, retryFor, func() (net.Listener, error) {
+			return net.Listen("tcp", tcpAddr)
+		})
+	}
+
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %w", mode, err)
+	}
+
+	// A socket left behind by an instance that didn't shut down cleanly
+	// would otherwise stop us binding.
+	if info, err := os.Stat(socket); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", socket)
+		}
+		if err = os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(socket, fs.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting socket mode: %w", err)
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+const (
+	cutReset     = "reset"
+	cutHalfClose = "half_close"
+
+	distributionUniform     = "uniform"
+	distributionExponential = "exponential"
+)
+
+// cutFault cuts a proportion of connections part way through their lifetime,
+// so the reconnect and retry logic in client drivers can be demonstrated. The
+// point in a connection's life it's cut at is drawn from the distribution.
+type cutFault struct {
+	// Probability is the chance of a connection being cut.
+	Probability float64 `json:"probability"`
+
+	// Mode is either "reset", which sends the client a TCP RST, or
+	// "half_close", which sends the client a FIN and stops forwarding the
+	// server's data.
+	Mode string `json:"mode,omitempty"`
+
+	// Distribution is "uniform" (between Min and Max) or "exponential"
+	// (with a mean of Mean, starting at Min).
+	Distribution string   `json:"distribution,omitempty"`
+	Min          duration `json:"min,omitempty"`
+	Max          duration `json:"max,omitempty"`
+	Mean         duration `json:"mean,omitempty"`
+}
+
+func (c *cutFault) validate() error {
+	if c.Probability < 0 || c.Probability > 1 {
+		return errors.New("cut probability must be between 0 and 1")
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = cutReset
+	case cutReset, cutHalfClose:
+	default:
+		return fmt.Errorf("invalid cut mode %q, must be %q or %q", c.Mode, cutReset, cutHalfClose)
+	}
+
+	if c.Min < 0 || c.Max < 0 || c.Mean < 0 {
+		return errors.New("cut durations can't be negative")
+	}
+
+	switch c.Distribution {
+	case "":
+		c.Distribution = distributionUniform
+		fallthrough
+	case distributionUniform:
+		if c.Max < c.Min {
+			return errors.New("cut max can't be less than min")
+		}
+	case distributionExponential:
+		if c.Mean <= 0 {
+			return errors.New("exponential cuts need a mean")
+		}
+	default:
+		return fmt.Errorf("invalid cut distribution %q, must be %q or %q", c.Distribution, distributionUniform, distributionExponential)
+	}
+
+	return nil
+}
+
+// schedule decides whether a new connection is to be cut, returning a channel
+// that fires when it's time to if so.
+func (c *cutFault) schedule() (<-chan time.Time, func()) {
+	if c == nil || rand.Float64() >= c.Probability {
+		return nil, func() {}
+	}
+
+	after := time.Duration(c.Min)
+	switch c.Distribution {
+	case distributionExponential:
+		after += time.Duration(rand.ExpFloat64() * float64(c.Mean))
+	default:
+		if spread := c.Max - c.Min; spread > 0 {
+			after += rand.N(time.Duration(spread))
+		}
+	}
+
+	t := time.NewTimer(after)
+	return t.C, func() { t.Stop() }
+}
+
+// cut applies the fault to the client connection, returning true if the
+// connection should carry on (half-closed).
+func (c *cutFault) cut(client net.Conn) bool {
+	tcp := tcpConn(client)
+	if tcp == nil {
+		return false
+	}
+
+	if c.Mode == cutHalfClose {
+		tcp.CloseWrite()
+		return true
+	}
+
+	// A zero linger makes closing the connection send a RST.
+	tcp.SetLinger(0)
+	return false
+}
+
+// tcpConn returns the TCP connection underneath c, if there is one.
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn
+		case *bufferedConn:
+			c = conn.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of c, so the other end reads EOF
+// while it can still send, returning false if c can't be half-closed.
+func closeWrite(c net.Conn) bool {
+	for {
+		switch conn := c.(type) {
+		case interface{ CloseWrite() error }:
+			return conn.CloseWrite() == nil
+		case *bufferedConn:
+			c = conn.Conn
+		default:
+			return false
+		}
+	}
+}
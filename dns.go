@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// dnsPublisher keeps a Cloudflare TXT record up to date with the active
+// groups, so external systems can discover the current routing state.
+type dnsPublisher struct {
+	token  string
+	zoneID string
+	record string
+	client *http.Client
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func newDNSPublisher(token, zoneID, record string) *dnsPublisher {
+	if token == "" || zoneID == "" || record == "" {
+		return nil
+	}
+
+	return &dnsPublisher{
+		token:  token,
+		zoneID: zoneID,
+		record: record,
+		client: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// publishActiveGroups updates the record whenever groups are activated or
+// drained.
+func (svr *server) publishActiveGroups(p *dnsPublisher) {
+	sub := svr.events.subscribe(16, eventActivation, eventDrain)
+
+	for e := range sub.c {
+		// Per-server drains don't change which groups are active.
+		if len(e.Servers) > 0 {
+			continue
+		}
+
+		content := "groups=" + strings.Join(e.Groups, ",")
+		if err := p.publish(content); err != nil {
+			log.Printf("error publishing dns record: %v", err)
+			continue
+		}
+
+		log.Printf("published %q to %s", content, p.record)
+	}
+}
+
+// publish creates or updates the TXT record with the given content.
+func (p *dnsPublisher) publish(content string) error {
+	path := fmt.Sprintf("/zones/%s/dns_records?type=TXT&name=%s", p.zoneID, url.QueryEscape(p.record))
+
+	var existing []cloudflareRecord
+	if err := p.do(http.MethodGet, path, nil, &existing); err != nil {
+		return fmt.Errorf("looking up record: %w", err)
+	}
+
+	record := cloudflareRecord{
+		Type:    "TXT",
+		Name:    p.record,
+		Content: content,
+		TTL:     60,
+	}
+
+	if len(existing) == 0 {
+		if err := p.do(http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", p.zoneID), record, nil); err != nil {
+			return fmt.Errorf("creating record: %w", err)
+		}
+		return nil
+	}
+
+	if err := p.do(http.MethodPut, fmt.Sprintf("/zones/%s/dns_records/%s", p.zoneID, existing[0].ID), record, nil); err != nil {
+		return fmt.Errorf("updating record: %w", err)
+	}
+	return nil
+}
+
+func (p *dnsPublisher) do(method, path string, body, result any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshalling request: %w", err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, cloudflareAPI+path, r)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling cloudflare: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var cr cloudflareResponse
+	if err = json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+		return fmt.Errorf("cloudflare responded with %s", resp.Status)
+	}
+
+	if !cr.Success {
+		if len(cr.Errors) > 0 {
+			return fmt.Errorf("cloudflare responded with %s: %s", resp.Status, cr.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare responded with %s", resp.Status)
+	}
+
+	if result != nil {
+		if err = json.Unmarshal(cr.Result, result); err != nil {
+			return fmt.Errorf("parsing response: %w", err)
+		}
+	}
+
+	return nil
+}
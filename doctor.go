@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const minFileLimit = 4096
+
+type check struct {
+	name string
+	err  error
+}
+
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	port := fs.Int("port", 26257, "port number for proxy requests")
+	ctlPort := fs.Int("ctl-port", 3000, "port number for proxy control requests")
+	ctlAddr := fs.String("ctl-addr", "localhost", "address the control port will be bound to")
+	timeout := fs.Duration("timeout", time.Second*3, "timeout for backend reachability checks")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of dp doctor:\n  dp doctor [flags] [server ...]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	checks := []check{
+		{name: fmt.Sprintf("proxy port %d is free", *port), err: portFree(fmt.Sprintf("localhost:%d", *port))},
+		{name: fmt.Sprintf("control port %d is free", *ctlPort), err: portFree(net.JoinHostPort(*ctlAddr, fmt.Sprint(*ctlPort)))},
+		{name: fmt.Sprintf("file descriptor limit is at least %d", minFileLimit), err: checkFileLimit(minFileLimit)},
+	}
+
+	for _, server := range fs.Args() {
+		checks = append(checks, check{
+			name: fmt.Sprintf("backend %s is reachable", server),
+			err:  reachable(server, *timeout),
+		})
+	}
+
+	var failed int
+	for _, c := range checks {
+		if c.err != nil {
+			failed++
+			log.Printf("[FAIL] %s: %v", c.name, c.err)
+			continue
+		}
+		log.Printf("[OK]   %s", c.name)
+	}
+
+	if failed > 0 {
+		log.Printf("%d of %d checks failed", failed, len(checks))
+		os.Exit(1)
+	}
+	log.Printf("all %d checks passed", len(checks))
+}
+
+func portFree(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+func reachable(server string, timeout time.Duration) error {
+	if server == internalEcho {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+func checkFileLimit(min uint64) error {
+	// File descriptor limits aren't a concern on platforms without rlimits.
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func checkFileLimit(min uint64) error {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return fmt.Errorf("getting file limit: %w", err)
+	}
+
+	if uint64(limit.Cur) < min {
+		return fmt.Errorf("soft limit is %d (hard limit %d), raise it with ulimit -n", limit.Cur, limit.Max)
+	}
+
+	return nil
+}
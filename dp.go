@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/codingconcepts/errhandler"
 	"github.com/samber/lo"
@@ -17,59 +24,302 @@ import (
 
 var (
 	version string
+
+	errNoServers = errors.New("no active servers")
 )
 
+// shutdownTimeout is how long in-flight control requests are given to
+// complete when dp shuts down.
+const shutdownTimeout = time.Second * 5
+
+// dialRetryBackoff is how much longer to wait before each retry of a failed
+// dial.
+const dialRetryBackoff = time.Millisecond * 100
+
 func main() {
 	log.SetFlags(0)
-	port := flag.Int("port", 26257, "port number for proxy requests")
-	ctlPort := flag.Int("ctl-port", 3000, "port number for proxy control requests")
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gen":
+			runGen(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		case "soak":
+			runSoak(os.Args[2:])
+			return
+		case "echo":
+			runEcho(os.Args[2:])
+			return
+		case "bind":
+			runBind(os.Args[2:])
+			return
+		}
+	}
+
+	var cfg serverConfig
+	cfg.register(flag.CommandLine)
+
+	ctlAddr := flag.String("ctl-addr", "localhost", "address to bind the control port to (empty for all interfaces)")
+	ctlSocket := flag.String("ctl-socket", "", "unix socket to serve control requests on instead of the control port")
+	ctlSocketMode := flag.String("ctl-socket-mode", "0600", "file mode of the control socket")
 	showVersion := flag.Bool("version", false, "show the application version")
-	debug := flag.Bool("debug", false, "enable debug-level logging")
+	dnsToken := flag.String("dns-token", "", "Cloudflare API token for publishing the active groups to a TXT record")
+	dnsZone := flag.String("dns-zone", "", "Cloudflare zone ID of the TXT record")
+	dnsRecord := flag.String("dns-record", "", "name of the TXT record to publish the active groups to")
+	bindRetry := flag.Duration("bind-retry", 0, "how long to keep retrying if the proxy or control port is in use")
+	sshDir := flag.String("ssh-dir", "", "directory ssh egress key_file and known_hosts paths are read from")
+	startupJSON := flag.Bool("startup-json", false, "print a machine-readable startup result to stdout")
 	flag.Parse()
 
+	st := startup{
+		json:      *startupJSON,
+		port:      cfg.port,
+		ctlPort:   cfg.ctlPort,
+		ctlSocket: *ctlSocket,
+	}
+
 	if *showVersion {
 		log.Printf("dp version %s", version)
 		return
 	}
 
-	svr := server{
-		httpPort:        *ctlPort,
-		terminateSignal: make(chan struct{}, 1),
-		serverGroups:    map[string]group{},
-		debug:           *debug,
+	if flag.NArg() > 0 {
+		st.fail(exitBadFlags, "flags", fmt.Errorf("unexpected arguments: %v", flag.Args()))
+	}
+
+	if cfg.staticDir != "" {
+		if info, err := os.Stat(cfg.staticDir); err != nil || !info.IsDir() {
+			st.fail(exitConfigError, "config", fmt.Errorf("static directory %q is not a directory", cfg.staticDir))
+		}
+	}
+
+	sshTunnels.dir = *sshDir
+
+	if err := validatePort(cfg.backendPort); err != nil {
+		st.fail(exitConfigError, "config", fmt.Errorf("-backend-port: %w", err))
+	}
+
+	if dnsFlags := lo.Compact([]string{*dnsToken, *dnsZone, *dnsRecord}); len(dnsFlags) > 0 && len(dnsFlags) < 3 {
+		st.fail(exitConfigError, "config", errors.New("-dns-token, -dns-zone and -dns-record must be given together"))
 	}
 
-	go svr.httpServer(*ctlPort)
+	svr := newServer(cfg)
 
-	proxyAddr := fmt.Sprintf("localhost:%d", *port)
-	listener, err := net.Listen("tcp", proxyAddr)
+	go svr.runActivationHooks()
+	go svr.runHealthChecks()
+
+	if p := newDNSPublisher(*dnsToken, *dnsZone, *dnsRecord); p != nil {
+		go svr.publishActiveGroups(p)
+	}
+
+	inherited, err := inheritedListeners()
 	if err != nil {
-		log.Fatalf("error starting proxy server: %v", err)
+		st.fail(exitBindFailure, "bind", err)
 	}
 
-	log.Printf("ready")
+	ctlListener := inherited[listenerControl]
+	if ctlListener == nil {
+		if ctlListener, err = listenControl(*ctlAddr, cfg.ctlPort, *ctlSocket, *ctlSocketMode, *bindRetry); err != nil {
+			st.fail(exitBindFailure, "bind", fmt.Errorf("binding control port: %w", privilegedPortHint(err)))
+		}
+	}
 
-	for {
-		if err = svr.accept(listener); err != nil {
-			log.Printf("error in accept: %v", err)
+	// Either server failing ends the process, via main, rather than
+	// leaving the other running on its own.
+	errs := make(chan error, 2)
+
+	ctlServer := svr.httpServer()
+	go func() {
+		if err := ctlServer.Serve(ctlListener); !errors.Is(err, http.ErrServerClosed) {
+			errs <- fmt.Errorf("serving control requests: %w", err)
+		}
+	}()
+
+	listener := inherited[listenerProxy]
+	if listener != nil {
+		svr.listener.inherit(listener)
+	} else {
+		proxyAddr := fmt.Sprintf("localhost:%d", cfg.port)
+		if listener, err = svr.listener.listen(proxyAddr, *bindRetry); err != nil {
+			st.fail(exitBindFailure, "bind", fmt.Errorf("binding proxy port: %w", privilegedPortHint(err)))
 		}
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		errs <- svr.serveProxy(listener)
+	}()
+
+	st.ready()
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		log.Printf("shutting down")
+	case serveErr = <-errs:
+	}
+
+	listener.Close()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err = ctlServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error shutting down control server: %v", err)
+	}
+
+	if serveErr != nil {
+		log.Printf("error running proxy server: %v", serveErr)
+		os.Exit(exitServeError)
+	}
 }
 
 type server struct {
 	httpPort    int
-	connections int64
+	port        int
+	connections *gauges
+	registry    *registry
 	debug       bool
+	preamble    bool
+	peekLimits  peekLimits
+	staticDir   string
+
+	preflightTimeout time.Duration
 
 	serversMu    sync.RWMutex
 	serverGroups map[string]group
-
-	terminateSignal chan struct{}
+	// cordonedServers receive no new connections, whichever group they're
+	// in. They're kept apart from groups, so redefining a group doesn't
+	// uncordon its servers.
+	cordonedServers map[string]bool
+	blueGreen       *blueGreen
+	tags            map[string]tagPolicy
+	pins            []pin
+	rules           []rule
+	annotations     map[string]string
+	failover        *failover
+
+	latency        *latencyHistograms
+	stats          *stats
+	tagConnections *gauges
+	quotas         *quotas
+	auth           *authenticator
+
+	ctlLimiter  *clientLimiter
+	idempotency *idempotencyCache
+
+	listener           *listenerState
+	panics             *panicCounters
+	hooks              *activationHooks
+	routePlugin        *routePlugin
+	backendPort        int
+	health             *healthChecks
+	outliers           *outliers
+	dialTimeout        time.Duration
+	dialRetries        int
+	stuckAfter         time.Duration
+	resetStuck         bool
+	balancers          map[string]balancer
+	affinity           *affinity
+	protocols          *protocolCounts
+	events             *eventBus
+	connLimit          *connLimit
+	pendingTermination *pendingTermination
 }
 
 type group struct {
-	Active  bool     `json:"active"`
-	Servers []string `json:"servers"`
+	Active   bool     `json:"active"`
+	Servers  []string `json:"servers"`
+	Egress   *egress  `json:"egress,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+
+	// Balance decides how a server is picked from the group for each
+	// connection (random by default).
+	Balance string `json:"balance,omitempty"`
+
+	// Compression compresses connections to the group's servers, which
+	// must be other dp instances running with -preamble.
+	Compression string `json:"compression,omitempty"`
+
+	// Port is added to servers given without one.
+	Port int `json:"port,omitempty"`
+
+	// Template computes a server address per connection instead of picking
+	// one of Servers, filling placeholders such as {sni} from the client.
+	Template string `json:"template,omitempty"`
+
+	// RetryError has protocol-aware groups reply with a transient error
+	// before closing terminated connections, where the protocol has no
+	// shutdown message of its own.
+	RetryError bool `json:"retry_error,omitempty"`
+
+	// HealthCheck probes the group's servers over HTTP, taking those that
+	// fail out of rotation. Health holds the latest results, filled in
+	// when groups are listed.
+	HealthCheck *healthCheck            `json:"health_check,omitempty"`
+	Health      map[string]healthResult `json:"health,omitempty"`
+
+	// Ejected holds servers taken out of rotation after repeatedly
+	// failing to dial, filled in when groups are listed.
+	Ejected map[string]ejection `json:"ejected,omitempty"`
+
+	// Faults are injected into the group's connections. They're set on
+	// their own rather than as part of the group's definition.
+	Faults *faults `json:"faults,omitempty"`
+
+	Locked bool `json:"locked,omitempty"`
+}
+
+type backend struct {
+	group      string
+	server     string
+	egress     *egress
+	protocol   string
+	retryError bool
+	faults     *faults
+
+	balance     string
+	compression string
+	healthCheck *healthCheck
+
+	// template is set if server is an address template to be expanded for
+	// each connection.
+	template bool
+}
+
+// serveProxy accepts client connections until the listener is closed.
+func (svr *server) serveProxy(listener net.Listener) error {
+	var delay time.Duration
+	for {
+		if err := svr.accept(listener); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("error in accept: %v", err)
+			delay = acceptBackoff(delay)
+			continue
+		}
+		delay = 0
+	}
+}
+
+const maxAcceptBackoff = time.Second
+
+// acceptBackoff waits before accepting again after a failed accept (such as
+// when dp's out of file descriptors), so the accept loop doesn't spin. It
+// returns the delay to wait the next time, doubling up to maxAcceptBackoff.
+func acceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		delay = time.Millisecond * 5
+	}
+	time.Sleep(delay)
+
+	return min(delay*2, maxAcceptBackoff)
 }
 
 func (svr *server) accept(listener net.Listener) error {
@@ -78,84 +328,647 @@ func (svr *server) accept(listener net.Listener) error {
 		return fmt.Errorf("accepting client connection: %w", err)
 	}
 
-	servers := svr.activeServers()
+	go svr.serve(client)
+	return nil
+}
+
+func (svr *server) serve(client net.Conn) {
+	id := newConnID()
+	defer svr.recoverConn(id, client)
+
+	if !svr.connLimit.acquire() {
+		if svr.debug {
+			fmt.Printf("[%s] rejecting client: port at connection limit\n", id)
+		}
+		client.Close()
+		return
+	}
+	defer svr.connLimit.release()
 
-	if len(servers) == 0 {
+	if !svr.quotas.allow(clientIP(client)) {
 		client.Close()
-		return nil
+		return
+	}
+
+	var tag string
+	if svr.preamble {
+		var p preamble
+		var err error
+		if client, p, err = readPreamble(client, svr.peekLimits); err != nil {
+			if svr.debug {
+				fmt.Printf("[%s] rejecting client: %v\n", id, err)
+			}
+			client.Close()
+			return
+		}
+		tag = p.tag
+
+		if p.compression != "" {
+			if client, err = acceptCompression(client, p.compression); err != nil {
+				if svr.debug {
+					fmt.Printf("[%s] rejecting client: %v\n", id, err)
+				}
+				client.Close()
+				return
+			}
+		}
+	}
+
+	policy, tagged := svr.tagPolicy(tag)
+	if tagged {
+		if !svr.tagConnections.tryInc(tag, policy.MaxConnections) {
+			if svr.debug {
+				fmt.Printf("[%s] rejecting client: tag %q at connection limit\n", id, tag)
+			}
+			client.Close()
+			return
+		}
+		defer svr.tagConnections.dec(tag)
+	}
+
+	ip := clientIP(client)
+
+	var pinned string
+	if p, ok := svr.pinFor(ip, tag); ok {
+		policy.Groups = []string{p.Group}
+		pinned = p.Server
+	} else {
+		var group string
+		if client, group = svr.ruleFor(client, ip, tag); group != "" {
+			if svr.debug {
+				fmt.Printf("[%s] routed to %s by rule\n", id, group)
+			}
+			policy.Groups = []string{group}
+		} else if !svr.routeByPlugin(client, id, tag, &policy) {
+			client.Close()
+			return
+		}
+	}
+
+	b, err := svr.selectServer(policy, ip, pinned)
+	if err != nil {
+		if svr.debug {
+			fmt.Printf("[%s] rejecting client: %v\n", id, err)
+		}
+		client.Close()
+		return
+	}
+
+	if b.template {
+		if client, b.server, err = expandTemplate(client, b.server, tag, svr.peekLimits); err != nil {
+			if svr.debug {
+				fmt.Printf("[%s] rejecting client: %v\n", id, err)
+			}
+			client.Close()
+			return
+		}
 	}
 
-	server := lo.Sample(servers)
 	if svr.debug {
-		fmt.Printf("server: %s\n", server)
+		fmt.Printf("[%s] server: %s\n", id, b.server)
 	}
 
-	go svr.handleClient(client, server)
-	return nil
+	veto := func(b backend) error {
+		return svr.hooks.vetoConnection(vetoRequest{ID: id, Client: client.RemoteAddr().String(), Group: b.group, Server: b.server, Tag: tag})
+	}
+
+	if err = veto(b); err != nil {
+		if svr.debug {
+			fmt.Printf("[%s] rejecting client: %v\n", id, err)
+		}
+		client.Close()
+		return
+	}
+
+	if how := b.faults.refuse(client); how != "" {
+		if svr.debug {
+			fmt.Printf("[%s] closed: %s by fault\n", id, how)
+		}
+		client.Close()
+		return
+	}
+
+	// Servers that can't be dialed are swapped for another of the group's
+	// servers, then any other server. Template addresses are only known for
+	// this client, so there's nothing to fail over to.
+	var failover func(failed backend, tried map[string]bool) (backend, error)
+	if !b.template {
+		failover = func(failed backend, tried map[string]bool) (backend, error) {
+			backends := lo.Filter(svr.candidates(policy), func(b backend, _ int) bool {
+				return !tried[b.server]
+			})
+			if same := lo.Filter(backends, func(b backend, _ int) bool { return b.group == failed.group }); len(same) > 0 {
+				backends = same
+			}
+
+			next, err := svr.selectFrom(backends, ip, pinned)
+			if err != nil {
+				return backend{}, err
+			}
+			return next, veto(next)
+		}
+	}
+
+	svr.handleClient(client, b, failover, connInfo{
+		ID:     id,
+		Client: client.RemoteAddr().String(),
+		Tag:    tag,
+	})
 }
 
-func (svr *server) handleClient(client net.Conn, server string) {
-	tcpServer, err := dial(client, server)
-	if err != nil {
-		// Error will be obvious from connected clients.
+// routeByPlugin asks the route plugin (if there is one) where a connection
+// should go, pointing the policy at the group it picks. It returns false if
+// the plugin rejects the connection. Connections the plugin can't decide in
+// time are routed as usual.
+func (svr *server) routeByPlugin(client net.Conn, id, tag string, policy *tagPolicy) bool {
+	if svr.routePlugin == nil {
+		return true
+	}
+
+	groups := policy.Groups
+	if len(groups) == 0 {
+		groups = svr.activeGroups()
+	}
+
+	d, err := svr.routePlugin.route(routeRequest{ID: id, Client: client.RemoteAddr().String(), Tag: tag, Groups: groups})
+	switch {
+	case err != nil:
+		if svr.debug {
+			fmt.Printf("[%s] routing without plugin: %v\n", id, err)
+		}
+	case d.Reject != "":
+		if svr.debug {
+			fmt.Printf("[%s] rejecting client: rejected by route plugin: %s\n", id, d.Reject)
+		}
+		return false
+	case d.Group != "":
+		if svr.debug {
+			fmt.Printf("[%s] routed to %s by plugin\n", id, d.Group)
+		}
+		policy.Groups = []string{d.Group}
+	}
+
+	return true
+}
+
+// selectServer picks a server from the active groups (or the groups tagged
+// or pinned connections are routed to), returning the server along with its
+// group and everything needed to dial it. A pinned server is picked if it's
+// in rotation.
+func (svr *server) selectServer(policy tagPolicy, ip, pinned string) (backend, error) {
+	return svr.selectFrom(svr.candidates(policy), ip, pinned)
+}
+
+// candidates returns the backends in rotation for a connection.
+func (svr *server) candidates(policy tagPolicy) []backend {
+	var backends []backend
+	if len(policy.Groups) > 0 {
+		backends = svr.namedServers(policy.Groups)
+	} else {
+		backends = svr.activeServers()
+	}
+
+	healthy := lo.Filter(backends, func(b backend, _ int) bool {
+		return svr.health.healthy(b)
+	})
+
+	// Ejections never take the last servers out of rotation, so clients
+	// can still reach whichever of them recovers first.
+	inRotation := lo.Filter(healthy, func(b backend, _ int) bool {
+		return !svr.outliers.ejected(b.server)
+	})
+	if len(inRotation) == 0 {
+		return healthy
+	}
+	return inRotation
+}
+
+func (svr *server) selectFrom(backends []backend, ip, pinned string) (backend, error) {
+	if len(backends) == 0 {
+		return backend{}, errNoServers
+	}
+
+	if b, ok := lo.Find(backends, func(b backend) bool { return pinned != "" && b.server == pinned }); ok {
+		return b, nil
+	}
+
+	if b, ok := svr.affinity.lookup(ip, backends); ok {
+		svr.affinity.stick(ip, b)
+		return b, nil
+	}
+
+	// When every group in rotation is balanced by hashing, the group is
+	// hashed too, scoring every server in rotation together, so clients
+	// stick to a server whichever group it's in.
+	if lo.EveryBy(backends, func(b backend) bool { return b.balance == balanceHash }) {
+		b := svr.balancers[balanceHash].pick("", ip, backends)
+		svr.affinity.stick(ip, b)
+		return b, nil
+	}
+
+	// Otherwise groups are picked at random, weighted by their number of
+	// servers, and then a server's picked however the group balances them.
+	b := lo.Sample(backends)
+	b = svr.balancers[b.balance].pick(b.group, ip, lo.Filter(backends, func(other backend, _ int) bool {
+		return other.group == b.group
+	}))
+
+	svr.affinity.stick(ip, b)
+	return b, nil
+}
+
+func (svr *server) handleClient(client net.Conn, b backend, failover func(backend, map[string]bool) (backend, error), info connInfo) {
+	// Subscribe before dialing, so a termination while dialing isn't missed.
+	terminated := svr.events.subscribeTerminations()
+	defer svr.events.unsubscribeTerminations(terminated)
+
+	start := time.Now()
+	tried := map[string]bool{}
+
+	var tcpServer net.Conn
+	for {
+		var err error
+		if tcpServer, err = svr.dialBackend(client, b); err == nil {
+			break
+		}
+		if svr.debug {
+			fmt.Printf("[%s] dialing %s: %v\n", info.ID, b.server, err)
+		}
+
+		tried[b.server] = true
+		if failover != nil {
+			if b, err = failover(b, tried); err == nil {
+				if svr.debug {
+					fmt.Printf("[%s] failing over to %s\n", info.ID, b.server)
+				}
+				continue
+			}
+			if svr.debug {
+				fmt.Printf("[%s] rejecting client: %v\n", info.ID, err)
+			}
+		}
+
+		client.Close()
 		return
 	}
+	svr.latency.record(b.group, info.ID, time.Since(start))
+
+	info.Server = b.server
+	info.Group = b.group
 
 	// Ensure the client and server are closed.
 	defer tcpServer.Close()
 	defer client.Close()
 
-	go io.Copy(tcpServer, client)
-	go io.Copy(client, tcpServer)
+	m := svr.quotas.meter(info.ID, clientIP(client))
+	defer m.close()
+
+	counted := svr.stats.connection(b.group)
+	defer counted.close()
+	toServer := svr.protocols.writer(b.group, counted.writer(true, m.writer(tcpServer)))
+	toClient := counted.writer(false, m.writer(client))
 
-	// Wait for server to change and allow function to complete (and connection
-	// to close) when it does.
-	atomic.AddInt64(&svr.connections, 1)
-	<-svr.terminateSignal
-	atomic.AddInt64(&svr.connections, -1)
+	pw := newProtocolWatcher(b)
+	if pw != nil {
+		toServer = pw.toServer(toServer)
+		toClient = pw.toClient(toClient)
+	}
+
+	// Either side hanging up ends the connection. A side that finishes
+	// sending (as opposed to failing) is half-closed instead, passing its
+	// FIN on to the other side, which can carry on sending until it's done
+	// too.
+	done := make(chan struct{})
+	var once sync.Once
+	hangup := func() { once.Do(func() { close(done) }) }
+
+	var sending int32 = 2
+	finish := func(halfClose bool, dst net.Conn) {
+		if halfClose && atomic.AddInt32(&sending, -1) > 0 && closeWrite(dst) {
+			return
+		}
+		hangup()
+	}
+
+	serverDone := make(chan struct{})
+
+	if b.faults != nil {
+		toServer = b.faults.toServer(toServer)
+		toClient = b.faults.toClient(toClient)
+	}
+
+	var pg progress
+	toServer = pg.toServer(toServer)
+	toClient = pg.toClient(toClient)
+
+	go func() {
+		defer svr.recoverConn(info.ID, client, tcpServer)
+
+		// Anything but a clean EOF (including a panic) hangs up.
+		halfClose := false
+		defer func() { finish(halfClose, tcpServer) }()
+
+		_, err := io.Copy(toServer, client)
+		flushWriter(toServer)
+		halfClose = err == nil
+	}()
+	go func() {
+		defer svr.recoverConn(info.ID, client, tcpServer)
+		defer close(serverDone)
+
+		halfClose := false
+		defer func() { finish(halfClose, client) }()
+
+		_, err := io.Copy(toClient, tcpServer)
+		flushWriter(toClient)
+		halfClose = err == nil
+	}()
+
+	svr.connections.inc(b.group)
+	defer svr.connections.dec(b.group)
+
+	info.Started = time.Now()
+	svr.registry.add(info)
+	defer svr.registry.remove(info.ID)
+
+	// Wait for server to change (or for the connection to end or blow its
+	// quota) and allow function to complete (and connection to close) when
+	// it does.
+	var cut *cutFault
+	if b.faults != nil {
+		cut = b.faults.Cuts
+	}
+	cutNow, stopCut := cut.schedule()
+	defer stopCut()
+
+	var watchdog <-chan time.Time
+	if svr.stuckAfter > 0 {
+		ticker := time.NewTicker(watchdogInterval(svr.stuckAfter))
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	var stuck bool
+
+	var reason string
+	for reason == "" {
+		select {
+		case <-terminated.c:
+			if !terminated.targets(b.server) {
+				continue
+			}
+			reason = "terminated"
+			if pw != nil {
+				pw.shutdown(client, tcpServer, serverDone)
+			}
+		case <-m.exceeded:
+			reason = "quota exceeded"
+		case <-done:
+			reason = "hung up"
+		case <-cutNow:
+			if cut.cut(client) {
+				if svr.debug {
+					fmt.Printf("[%s] half-closed by fault\n", info.ID)
+				}
+				continue
+			}
+			reason = "reset by fault"
+		case <-watchdog:
+			stuckFor := pg.stuckFor()
+			if stuckFor < svr.stuckAfter {
+				if stuck {
+					log.Printf("[%s] %s is responding again", info.ID, b.server)
+					svr.registry.setStuck(info.ID, nil)
+					stuck = false
+				}
+				continue
+			}
+
+			if !stuck {
+				log.Printf("[%s] stuck: %s hasn't responded for %s", info.ID, b.server, stuckFor.Round(time.Millisecond))
+				since := time.Now().Add(-stuckFor)
+				svr.registry.setStuck(info.ID, &since)
+				stuck = true
+			}
+
+			if svr.resetStuck {
+				for _, c := range []net.Conn{client, tcpServer} {
+					if tcp := tcpConn(c); tcp != nil {
+						tcp.SetLinger(0)
+					}
+				}
+				reason = "reset while stuck"
+			}
+		}
+	}
+
+	if svr.debug {
+		fmt.Printf("[%s] closed: %s\n", info.ID, reason)
+	}
+}
+
+// dialBackend dials a backend, trying again up to -dial-retries times if it
+// fails.
+func (svr *server) dialBackend(client net.Conn, b backend) (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt <= svr.dialRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(dialRetryBackoff * time.Duration(attempt))
+		}
+
+		var conn net.Conn
+		conn, err = dial(client, b, svr.dialTimeout)
+		if !b.template {
+			svr.outliers.record(b.server, err)
+		}
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
 }
 
-func dial(client net.Conn, server string) (net.Conn, error) {
+func dial(client net.Conn, b backend, timeout time.Duration) (net.Conn, error) {
+	if b.server == internalEcho {
+		return dialEcho(), nil
+	}
+
+	conn, err := dialServer(b, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.compression != "" {
+		compressed, err := negotiateCompression(conn, b.compression)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = compressed
+	}
+
 	if _, ok := client.(*tls.Conn); ok {
+		host, _, _ := net.SplitHostPort(b.server)
 		tlsConfig := &tls.Config{
 			InsecureSkipVerify: false,
+			ServerName:         host,
 		}
 
-		return tls.Dial("tcp", server, tlsConfig)
+		return tls.Client(conn, tlsConfig), nil
 	}
 
-	return net.Dial("tcp", server)
+	return conn, nil
 }
 
-func (svr *server) httpServer(port int) {
-	m := http.NewServeMux()
+// dialServer dials a backend's server, directly or through its egress,
+// giving up after timeout (unless it's zero).
+func dialServer(b backend, timeout time.Duration) (net.Conn, error) {
+	if b.egress == nil {
+		return net.DialTimeout("tcp", b.server, timeout)
+	}
+	if timeout == 0 {
+		return b.egress.dial(b.server)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
 
-	m.Handle("GET /groups", errhandler.Wrap(svr.handleGetGroups))
-	m.Handle("POST /groups", errhandler.Wrap(svr.handleSetGroup))
-	m.Handle("DELETE /groups/{group}", errhandler.Wrap(svr.handleDeleteGroup))
-	m.Handle("POST /activate", errhandler.Wrap(svr.handleActivation))
+	done := make(chan result, 1)
+	go func() {
+		conn, err := b.egress.dial(b.server)
+		done <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// Close the connection if the egress gets there in the end.
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dialing %s through %s egress: timed out after %s", b.server, b.egress.Type, timeout)
+	}
+}
 
-	s := &http.Server{
-		Handler: m,
-		Addr:    fmt.Sprintf(":%d", port),
+func (svr *server) httpServer() *http.Server {
+	m := http.NewServeMux()
+
+	viewer := svr.authorize(roleViewer)
+	operator := svr.authorize(roleOperator)
+	admin := svr.authorize(roleAdmin)
+	idempotent := svr.idempotency.middleware
+
+	handle := versionedRoutes(m)
+
+	handle("GET /groups", viewer(svr.handleGetGroups))
+	handle("POST /groups", admin(idempotent(svr.handleSetGroup)))
+	handle("DELETE /groups/{group}", admin(svr.handleDeleteGroup))
+	handle("POST /groups/{group}/import", admin(idempotent(svr.handleImportServers)))
+	handle("PUT /groups/{group}/faults", admin(svr.handleSetFaults))
+	handle("DELETE /groups/{group}/faults", admin(svr.handleDeleteFaults))
+	handle("GET /faults/presets", viewer(svr.handleGetPresets))
+	handle("PUT /groups/{group}/lock", admin(svr.handleLockGroup))
+	handle("DELETE /groups/{group}/lock", admin(svr.handleUnlockGroup))
+	handle("POST /activate", operator(idempotent(svr.handleActivation)))
+	handle("POST /activate/abort", operator(svr.handleAbortTermination))
+	handle("GET /bluegreen", viewer(svr.handleGetBlueGreen))
+	handle("PUT /bluegreen", admin(svr.handleSetBlueGreen))
+	handle("POST /bluegreen/swap", operator(idempotent(svr.handleSwapBlueGreen)))
+	handle("GET /bluegreen/failover", viewer(svr.handleGetFailover))
+	handle("PUT /bluegreen/failover", admin(svr.handleSetFailover))
+	handle("POST /bluegreen/failover/confirm", operator(svr.handleConfirmFailover))
+	handle("POST /servers/{addr}/drain", operator(svr.handleDrainServer))
+	handle("DELETE /servers/{addr}/drain", operator(svr.handleUncordonServer))
+	handle("GET /servers", viewer(svr.handleGetServers))
+	handle("POST /servers/{addr}/cordon", operator(svr.handleCordonServer))
+	handle("POST /servers/{addr}/uncordon", operator(svr.handleUncordonServer))
+	handle("GET /tags", viewer(svr.handleGetTags))
+	handle("PUT /tags/{tag}", admin(svr.handleSetTag))
+	handle("DELETE /tags/{tag}", admin(svr.handleDeleteTag))
+	handle("GET /pins", viewer(svr.handleGetPins))
+	handle("PUT /pins", operator(svr.handleSetPins))
+	handle("GET /rules", viewer(svr.handleGetRules))
+	handle("PUT /rules", operator(svr.handleSetRules))
+	handle("GET /affinity", viewer(svr.handleGetAffinity))
+	handle("DELETE /affinity", operator(svr.handleFlushAffinity))
+	handle("GET /annotations", viewer(svr.handleGetAnnotations))
+	handle("PUT /annotations/{key}", admin(svr.handleSetAnnotation))
+	handle("DELETE /annotations/{key}", admin(svr.handleDeleteAnnotation))
+	handle("GET /listener", viewer(svr.handleGetListener))
+	handle("GET /ports", viewer(svr.handleGetPorts))
+	handle("GET /hooks", viewer(svr.handleGetHooks))
+	handle("PUT /hooks", admin(svr.handleSetHooks))
+	handle("GET /events", viewer(svr.handleEvents))
+	handle("GET /latency", viewer(svr.handleGetLatency))
+	handle("GET /stats", viewer(svr.handleGetStats))
+	handle("GET /protocols", viewer(svr.handleGetProtocols))
+	handle("GET /quotas", viewer(svr.handleGetQuotas))
+	handle("GET /connections", viewer(svr.handleGetConnections))
+	handle("GET /panics", viewer(svr.handleGetPanics))
+
+	if svr.staticDir != "" {
+		m.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.Dir(svr.staticDir))))
 	}
 
-	log.Fatal(s.ListenAndServe())
+	return &http.Server{
+		Handler: withRequestID(svr.recoverHandler(svr.ctlLimiter.middleware(m))),
+	}
 }
 
 func (svr *server) handleGetGroups(w http.ResponseWriter, r *http.Request) error {
 	log.Println("[START] handleGetGroups")
 	defer log.Println("[END] handleGetGroups")
 
+	p, err := parsePage(r)
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	active, err := parseBoolFilter(r, "active")
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
 	svr.serversMu.RLock()
 	defer svr.serversMu.RUnlock()
 
-	return errhandler.SendJSON(w, svr.serverGroups)
+	var names []string
+	for name, g := range svr.serverGroups {
+		if p.matches(name) && (active == nil || g.Active == *active) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	groups := map[string]group{}
+	for _, name := range paginate(w, p, names) {
+		g := svr.serverGroups[name]
+		g.Health = svr.health.groupResults(name)
+		g.Ejected = svr.outliers.groupEjections(g.Servers)
+		g.Egress = g.Egress.redacted()
+		groups[name] = g
+	}
+
+	return errhandler.SendJSON(w, groups)
 }
 
 type setGroupRequest struct {
-	Name    string   `json:"name"`
-	Servers []string `json:"servers"`
+	Name       string   `json:"name"`
+	Servers    []string `json:"servers"`
+	Egress     *egress  `json:"egress"`
+	Protocol   string   `json:"protocol"`
+	RetryError bool     `json:"retry_error"`
+	Template   string   `json:"template"`
+	Port       int      `json:"port"`
+
+	Balance     string       `json:"balance"`
+	Compression string       `json:"compression"`
+	HealthCheck *healthCheck `json:"health_check"`
 }
 
 func (svr *server) handleSetGroup(w http.ResponseWriter, r *http.Request) error {
@@ -167,9 +980,53 @@ func (svr *server) handleSetGroup(w http.ResponseWriter, r *http.Request) error
 		return errhandler.Error(http.StatusUnprocessableEntity, err)
 	}
 
+	if req.Egress != nil {
+		if err := req.Egress.validate(); err != nil {
+			return errhandler.Error(http.StatusUnprocessableEntity, err)
+		}
+	}
+
+	if err := validateProtocol(req.Protocol); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	if err := validateBalance(req.Balance); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	if err := validateCompression(req.Compression); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	if err := validatePort(req.Port); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	var err error
+	if req.Servers, err = svr.resolveServers(req.Servers, req.Port); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	if req.HealthCheck != nil {
+		if err := req.HealthCheck.validate(); err != nil {
+			return errhandler.Error(http.StatusUnprocessableEntity, err)
+		}
+	}
+
+	if req.Template != "" {
+		if len(req.Servers) > 0 {
+			return errhandler.Error(http.StatusUnprocessableEntity, errors.New("a group can have servers or a template, not both"))
+		}
+		if err := validateTemplate(req.Template); err != nil {
+			return errhandler.Error(http.StatusUnprocessableEntity, err)
+		}
+	}
+
 	log.Printf("[SET] group: %q servers: %v", req.Name, req.Servers)
 
-	svr.setGroupServers(req.Name, req.Servers)
+	if err := svr.setGroup(req); err != nil {
+		return errhandler.Error(http.StatusConflict, err)
+	}
 
 	return nil
 }
@@ -180,13 +1037,30 @@ func (svr *server) handleDeleteGroup(w http.ResponseWriter, r *http.Request) err
 
 	group := r.PathValue("group")
 
-	svr.deleteGroup(group)
+	if err := svr.deleteGroup(group); err != nil {
+		return errhandler.Error(http.StatusConflict, err)
+	}
 
 	return nil
 }
 
 type activationRequest struct {
-	Groups []string `json:"groups"`
+	Groups    []string `json:"groups"`
+	Preflight bool     `json:"preflight"`
+
+	// Grace overrides -terminate-delay, letting existing connections
+	// finish for up to this long before they're closed.
+	Grace *duration `json:"grace"`
+}
+
+type activationResponse struct {
+	Before      map[string]bool  `json:"before"`
+	After       map[string]bool  `json:"after"`
+	Connections map[string]int64 `json:"connections"`
+
+	// PreflightSkipped lists the template groups a preflight couldn't
+	// check.
+	PreflightSkipped []string `json:"preflight_skipped,omitempty"`
 }
 
 func (svr *server) handleActivation(w http.ResponseWriter, r *http.Request) error {
@@ -198,41 +1072,94 @@ func (svr *server) handleActivation(w http.ResponseWriter, r *http.Request) erro
 		return errhandler.Error(http.StatusUnprocessableEntity, err)
 	}
 
+	if req.Grace != nil && *req.Grace < 0 {
+		return errhandler.Error(http.StatusUnprocessableEntity, errors.New("grace must not be negative"))
+	}
+
+	var resp activationResponse
+	if req.Preflight {
+		skipped, err := svr.preflight(req.Groups, svr.preflightTimeout)
+		if err != nil {
+			return errhandler.Error(http.StatusConflict, err)
+		}
+		resp.PreflightSkipped = skipped
+	}
+
+	resp.Before = svr.groupStates()
+	_, resp.Connections = svr.connections.snapshot()
+
 	svr.setActiveGroups(req.Groups)
+	resp.After = svr.groupStates()
 
-	close(svr.terminateSignal)
-	svr.terminateSignal = make(chan struct{})
+	if req.Grace != nil {
+		svr.terminateAfter(time.Duration(*req.Grace))
+	} else {
+		svr.terminate()
+	}
 
-	return nil
+	return errhandler.SendJSON(w, resp)
 }
 
-func (svr *server) deleteGroup(group string) {
+func (svr *server) deleteGroup(group string) error {
 	svr.serversMu.Lock()
 	defer svr.serversMu.Unlock()
 
+	if bg := svr.blueGreen; bg != nil && (bg.Live == group || bg.Standby == group) {
+		return fmt.Errorf("group %q has a blue/green role", group)
+	}
+
+	if svr.serverGroups[group].Locked {
+		return fmt.Errorf("group %q is locked", group)
+	}
+
+	if lo.SomeBy(svr.rules, func(r rule) bool { return r.Group == group }) {
+		return fmt.Errorf("group %q is used by a routing rule", group)
+	}
+
 	// Delete group.
 	delete(svr.serverGroups, group)
+	return nil
 }
 
-func (svr *server) setGroupServers(g string, servers []string) {
+func (svr *server) setGroup(req setGroupRequest) error {
 	svr.serversMu.Lock()
 	defer svr.serversMu.Unlock()
 
-	if foundGroup, ok := svr.serverGroups[g]; ok {
-		foundGroup.Servers = servers
-		svr.serverGroups[g] = foundGroup
-	} else {
-		svr.serverGroups[g] = group{
-			Active:  false,
-			Servers: servers,
+	g := group{
+		Servers:    req.Servers,
+		Egress:     req.Egress,
+		Protocol:   req.Protocol,
+		RetryError: req.RetryError,
+		Template:   req.Template,
+		Port:       req.Port,
+
+		Balance:     req.Balance,
+		Compression: req.Compression,
+		HealthCheck: req.HealthCheck,
+	}
+
+	if foundGroup, ok := svr.serverGroups[req.Name]; ok {
+		if foundGroup.Locked {
+			return fmt.Errorf("group %q is locked", req.Name)
 		}
+		g.Active = foundGroup.Active
+		g.Faults = foundGroup.Faults
 	}
+
+	svr.serverGroups[req.Name] = g
+	return nil
 }
 
 func (svr *server) setActiveGroups(groups []string) {
 	svr.serversMu.Lock()
 	defer svr.serversMu.Unlock()
 
+	svr.activateGroups(groups)
+}
+
+// activateGroups activates the given groups and deactivates all others. The
+// caller must hold serversMu.
+func (svr *server) activateGroups(groups []string) {
 	// Disable all groups (drain unless a group is found)
 	for k, v := range svr.serverGroups {
 		v.Active = false
@@ -240,7 +1167,7 @@ func (svr *server) setActiveGroups(groups []string) {
 	}
 
 	// Enable given groups.
-	var found bool
+	var activated []string
 
 	for _, g := range groups {
 		if foundGroup, ok := svr.serverGroups[g]; ok {
@@ -249,27 +1176,109 @@ func (svr *server) setActiveGroups(groups []string) {
 			foundGroup.Active = true
 			svr.serverGroups[g] = foundGroup
 
-			found = true
+			activated = append(activated, g)
 		}
 	}
 
 	// If no groups, log that we've drained.
-	if !found {
+	if len(activated) == 0 {
 		log.Printf("drained")
+		svr.events.publish(event{Kind: eventDrain})
+		return
 	}
+
+	svr.events.publish(event{Kind: eventActivation, Groups: activated})
+}
+
+// groupStates returns whether each group is active.
+func (svr *server) groupStates() map[string]bool {
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	states := make(map[string]bool, len(svr.serverGroups))
+	for name, group := range svr.serverGroups {
+		states[name] = group.Active
+	}
+
+	return states
+}
+
+// activeGroups returns the names of the active groups, sorted.
+func (svr *server) activeGroups() []string {
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	names := []string{}
+	for name, group := range svr.serverGroups {
+		if group.Active {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
 }
 
-func (svr *server) activeServers() []string {
+func (svr *server) activeServers() []backend {
 	svr.serversMu.RLock()
 	defer svr.serversMu.RUnlock()
 
-	var servers []string
+	var backends []backend
 
-	for _, group := range svr.serverGroups {
+	for name, group := range svr.serverGroups {
 		if group.Active {
-			servers = append(servers, group.Servers...)
+			backends = append(backends, svr.groupBackends(name)...)
 		}
 	}
 
-	return servers
+	return backends
+}
+
+func (svr *server) namedServers(groups []string) []backend {
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	var backends []backend
+	for _, g := range groups {
+		backends = append(backends, svr.groupBackends(g)...)
+	}
+
+	return backends
+}
+
+// groupBackends returns the backends of a group. The caller must hold
+// serversMu.
+func (svr *server) groupBackends(name string) []backend {
+	g := svr.serverGroups[name]
+
+	base := backend{
+		group:      name,
+		egress:     g.Egress,
+		protocol:   g.Protocol,
+		retryError: g.RetryError,
+		faults:     g.Faults,
+
+		balance:     g.Balance,
+		compression: g.Compression,
+		healthCheck: g.HealthCheck,
+	}
+
+	if g.Template != "" {
+		base.server = g.Template
+		base.template = true
+		return []backend{base}
+	}
+
+	backends := make([]backend, 0, len(g.Servers))
+	for _, s := range g.Servers {
+		if svr.cordonedServers[s] {
+			continue
+		}
+
+		b := base
+		b.server = s
+		backends = append(backends, b)
+	}
+
+	return backends
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestActivateWithLiveConnections switches the active group from several
+// goroutines while connections are being proxied and terminated, for the
+// race detector to check (go test -race).
+func TestActivateWithLiveConnections(t *testing.T) {
+	cfg := defaultServerConfig()
+	cfg.ctlRate = 0
+	svr := newServer(cfg)
+
+	for _, name := range []string{"blue", "green"} {
+		addr, err := startEcho()
+		if err != nil {
+			t.Fatalf("starting %s echo backend: %v", name, err)
+		}
+		if err = svr.setGroup(setGroupRequest{Name: name, Servers: []string{addr}}); err != nil {
+			t.Fatalf("creating %s group: %v", name, err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("binding proxy port: %v", err)
+	}
+	defer listener.Close()
+	go svr.serveProxy(listener)
+
+	ctl := httptest.NewServer(svr.httpServer().Handler)
+	defer ctl.Close()
+
+	activate(t, ctl.URL, "blue")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var echoed atomic.Int64
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ok, err := echoThrough(listener.Addr().String())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					echoed.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				activate(t, ctl.URL, []string{"blue", "green"}[(i+j)%2])
+			}
+		}(i)
+	}
+
+	time.Sleep(time.Millisecond * 500)
+	close(done)
+	wg.Wait()
+
+	if n := svr.panics.connections.Load(); n > 0 {
+		t.Fatalf("recovered %d connection panics", n)
+	}
+	if echoed.Load() == 0 {
+		t.Fatal("no connections were echoed in full")
+	}
+}
+
+func activate(t *testing.T, url, group string) {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"groups": [%q]}`, group)
+	resp, err := http.Post(url+"/v1/activate", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Errorf("activating %s: %v", group, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		t.Errorf("activating %s: %s: %s", group, resp.Status, b)
+	}
+}
+
+// echoThrough sends data through the proxy and checks it comes back intact,
+// returning whether all of it did. Connections terminated by an activation
+// part way through are fine, as long as what was echoed before then wasn't
+// corrupted.
+func echoThrough(addr string) (bool, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return false, fmt.Errorf("dialing proxy: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	sent := bytes.Repeat([]byte("dp"), 512)
+	if _, err = conn.Write(sent); err != nil {
+		return false, nil
+	}
+
+	got := make([]byte, len(sent))
+	n, _ := io.ReadFull(conn, got)
+	if !bytes.Equal(got[:n], sent[:n]) {
+		return false, fmt.Errorf("echo corrupted after %d bytes", n)
+	}
+	return n == len(sent), nil
+}
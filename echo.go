@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// internalEcho is a server address that dp serves itself, echoing back
+// everything it's sent, so weights and faults can be tried out without
+// standing up real backends.
+const internalEcho = "internal:echo"
+
+func runEcho(args []string) {
+	fs := flag.NewFlagSet("echo", flag.ExitOnError)
+	port := fs.Int("port", 27000, "port number to echo on")
+	banner := fs.String("banner", "", "line to send on each new connection (e.g. to tell backends apart)")
+	fs.Parse(args)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		log.Fatalf("error binding echo port: %v", err)
+	}
+
+	log.Printf("echoing on %s", listener.Addr())
+	serveEcho(listener, *banner)
+}
+
+// startEcho starts a backend on an ephemeral port that echoes everything
+// it's sent.
+func startEcho() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	go serveEcho(listener, "")
+
+	return listener.Addr().String(), nil
+}
+
+// serveEcho echoes connections until the listener is closed.
+func serveEcho(listener net.Listener, banner string) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("error in accept: %v", err)
+			delay = acceptBackoff(delay)
+			continue
+		}
+		delay = 0
+		go echo(conn, banner)
+	}
+}
+
+func echo(conn net.Conn, banner string) {
+	defer conn.Close()
+
+	if banner != "" {
+		if _, err := fmt.Fprintln(conn, banner); err != nil {
+			return
+		}
+	}
+	io.Copy(conn, conn)
+}
+
+// dialEcho returns one end of an in-memory connection, with the other end
+// echoing everything written to it.
+func dialEcho() net.Conn {
+	client, backend := net.Pipe()
+	go echo(backend, "")
+
+	return client
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	egressHTTP   = "http"
+	egressSOCKS5 = "socks5"
+	egressSSH    = "ssh"
+)
+
+// egress describes an upstream proxy that a group's servers are reached
+// through.
+type egress struct {
+	Type     string `json:"type"`
+	Addr     string `json:"addr"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// KeyFile and KnownHosts are only used by ssh egress, and are paths
+	// within -ssh-dir. Jump hosts' keys are only left unverified if
+	// Insecure is set.
+	KeyFile    string `json:"key_file,omitempty"`
+	KnownHosts string `json:"known_hosts,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+}
+
+func (e *egress) validate() error {
+	switch e.Type {
+	case egressHTTP, egressSOCKS5:
+	case egressSSH:
+		if e.Username == "" {
+			return fmt.Errorf("missing ssh egress username")
+		}
+		if e.KeyFile == "" && e.Password == "" {
+			return fmt.Errorf("ssh egress needs a key_file or password")
+		}
+		if e.KnownHosts == "" && !e.Insecure {
+			return fmt.Errorf("ssh egress needs known_hosts to verify the jump host (or insecure to skip verifying it)")
+		}
+		for _, name := range []string{e.KeyFile, e.KnownHosts} {
+			if name == "" {
+				continue
+			}
+			if _, err := sshTunnels.path(name); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid egress type %q, must be one of %q, %q or %q", e.Type, egressHTTP, egressSOCKS5, egressSSH)
+	}
+
+	if e.Addr == "" {
+		return fmt.Errorf("missing egress addr")
+	}
+
+	return nil
+}
+
+// redacted returns a copy of the egress without its password, for showing
+// to callers that can read groups but shouldn't see credentials.
+func (e *egress) redacted() *egress {
+	if e == nil {
+		return nil
+	}
+
+	r := *e
+	r.Password = ""
+	return &r
+}
+
+func (e *egress) dial(server string) (net.Conn, error) {
+	switch e.Type {
+	case egressSOCKS5:
+		return e.dialSOCKS5(server)
+	case egressSSH:
+		return e.dialSSH(server)
+	default:
+		return e.dialHTTP(server)
+	}
+}
+
+func (e *egress) dialSOCKS5(server string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if e.Username != "" {
+		auth = &proxy.Auth{User: e.Username, Password: e.Password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", e.Addr, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("creating socks5 dialer: %w", err)
+	}
+
+	return dialer.Dial("tcp", server)
+}
+
+func (e *egress) dialHTTP(server string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", e.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing http proxy: %w", err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Host:   server,
+		URL:    &url.URL{Opaque: server},
+		Header: http.Header{},
+	}
+	if e.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(e.Username + ":" + e.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	defer conn.SetDeadline(time.Time{})
+
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing connect request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading connect response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy refused connect: %s", resp.Status)
+	}
+
+	// The proxy may have sent bytes from the server after its response.
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose reads are served from a buffered reader
+// that may already hold data read from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
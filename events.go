@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type eventKind string
+
+const (
+	eventActivation eventKind = "activation"
+	eventDrain      eventKind = "drain"
+	eventTerminate  eventKind = "terminate"
+	eventHealth     eventKind = "health"
+)
+
+type event struct {
+	Kind    eventKind `json:"kind"`
+	Time    time.Time `json:"time"`
+	Groups  []string  `json:"groups,omitempty"`
+	Servers []string  `json:"servers,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// eventBus distributes internal notifications to whoever's interested, be
+// that proxied connections waiting to be terminated or a client streaming
+// events from the control API.
+type eventBus struct {
+	mu           sync.Mutex
+	subs         map[*subscription]struct{}
+	terminations map[*terminations]struct{}
+}
+
+type subscription struct {
+	kinds map[eventKind]bool
+	c     chan event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs:         map[*subscription]struct{}{},
+		terminations: map[*terminations]struct{}{},
+	}
+}
+
+// terminations collects the terminate events published for a connection.
+// Unlike subscriptions, they're never dropped: events are merged into the
+// set of servers terminated so far, and c is signalled whenever it changes,
+// so a connection busy dialing or shutting down still sees every
+// termination once it checks.
+type terminations struct {
+	c chan struct{}
+
+	mu      sync.Mutex
+	all     bool
+	servers map[string]bool
+}
+
+func (b *eventBus) subscribeTerminations() *terminations {
+	t := &terminations{
+		c:       make(chan struct{}, 1),
+		servers: map[string]bool{},
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.terminations[t] = struct{}{}
+	return t
+}
+
+func (b *eventBus) unsubscribeTerminations(t *terminations) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.terminations, t)
+}
+
+func (t *terminations) add(e event) {
+	t.mu.Lock()
+	if len(e.Servers) == 0 {
+		t.all = true
+	}
+	for _, s := range e.Servers {
+		t.servers[s] = true
+	}
+	t.mu.Unlock()
+
+	select {
+	case t.c <- struct{}{}:
+	default:
+		// Already signalled, and the check will see this event too.
+	}
+}
+
+// targets returns whether a termination so far applies to connections to
+// the server.
+func (t *terminations) targets(server string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.all || t.servers[server]
+}
+
+// subscribe returns a subscription to the given kinds of event (or all of
+// them if none are given). Events are dropped if the subscriber's buffer is
+// full, so subscribers that only care whether an event has happened at all
+// can use a buffer of 1.
+func (b *eventBus) subscribe(buffer int, kinds ...eventKind) *subscription {
+	sub := &subscription{
+		kinds: map[eventKind]bool{},
+		c:     make(chan event, buffer),
+	}
+	for _, k := range kinds {
+		sub.kinds[k] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, sub)
+}
+
+func (b *eventBus) publish(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e.Kind == eventTerminate {
+		for t := range b.terminations {
+			t.add(e)
+		}
+	}
+
+	for sub := range b.subs {
+		if len(sub.kinds) > 0 && !sub.kinds[e.Kind] {
+			continue
+		}
+
+		select {
+		case sub.c <- e:
+		default:
+		}
+	}
+}
+
+// handleEvents streams events to the client as server-sent events.
+func (svr *server) handleEvents(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleEvents")
+	defer log.Println("[END] handleEvents")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming not supported")
+	}
+
+	sub := svr.events.subscribe(64)
+	defer svr.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case e := <-sub.c:
+			data, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("marshalling event: %w", err)
+			}
+
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, data); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		}
+	}
+}
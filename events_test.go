@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestTerminationsNeverDropped checks that a connection that isn't reading
+// its terminations (e.g. while it's dialing) still sees a termination
+// published after many aimed at other servers.
+func TestTerminationsNeverDropped(t *testing.T) {
+	bus := newEventBus()
+	terminated := bus.subscribeTerminations()
+	defer bus.unsubscribeTerminations(terminated)
+
+	for i := 0; i < 100; i++ {
+		bus.publish(event{Kind: eventTerminate, Servers: []string{fmt.Sprintf("other:%d", i)}})
+	}
+	if terminated.targets("mine:1") {
+		t.Fatal("terminated by events aimed at other servers")
+	}
+
+	bus.publish(event{Kind: eventTerminate})
+
+	select {
+	case <-terminated.c:
+	default:
+		t.Fatal("not signalled")
+	}
+	if !terminated.targets("mine:1") {
+		t.Fatal("missed the termination of every server")
+	}
+}
+
+func TestTerminationsTargetServer(t *testing.T) {
+	bus := newEventBus()
+	terminated := bus.subscribeTerminations()
+	defer bus.unsubscribeTerminations(terminated)
+
+	bus.publish(event{Kind: eventActivation})
+	bus.publish(event{Kind: eventTerminate, Servers: []string{"a:1", "b:1"}})
+
+	<-terminated.c
+	if !terminated.targets("b:1") {
+		t.Fatal("missed the termination of b:1")
+	}
+	if terminated.targets("c:1") {
+		t.Fatal("c:1 terminated by an event aimed at a:1 and b:1")
+	}
+}
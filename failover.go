@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+	"github.com/samber/lo"
+)
+
+const maxFailoverEvents = 100
+
+// failoverPolicy promotes the standby group when the live group's health
+// (the fraction of its servers that can be dialed) stays below a threshold.
+type failoverPolicy struct {
+	Enabled   bool     `json:"enabled"`
+	Threshold float64  `json:"threshold"`
+	For       duration `json:"for"`
+	Interval  duration `json:"interval"`
+	Cooldown  duration `json:"cooldown"`
+
+	// Arbiter is an optional URL that must agree to a promotion before it
+	// happens, protecting against failovers caused by a partition between
+	// dp and the live group. It can be another dp's confirm endpoint.
+	Arbiter string `json:"arbiter,omitempty"`
+}
+
+// confirmRequest asks an arbiter to agree that the live group is unhealthy.
+type confirmRequest struct {
+	Live      string   `json:"live"`
+	Standby   string   `json:"standby"`
+	Servers   []string `json:"servers"`
+	Health    float64  `json:"health"`
+	Threshold float64  `json:"threshold"`
+}
+
+type failoverEvent struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type failover struct {
+	// arbiterToken authenticates confirm requests to the arbiter, set by
+	// -arbiter-token rather than the policy so it can't be read back.
+	arbiterToken string
+
+	mu     sync.Mutex
+	policy failoverPolicy
+	stop   chan struct{}
+
+	health         float64
+	unhealthySince time.Time
+	lastFailover   time.Time
+	warned         bool
+	events         []failoverEvent
+}
+
+type failoverResponse struct {
+	Policy         failoverPolicy  `json:"policy"`
+	Health         float64         `json:"health"`
+	UnhealthySince *time.Time      `json:"unhealthy_since,omitempty"`
+	LastFailover   *time.Time      `json:"last_failover,omitempty"`
+	Events         []failoverEvent `json:"events"`
+}
+
+func (p *failoverPolicy) validate() error {
+	if !p.Enabled {
+		return nil
+	}
+
+	if p.Threshold <= 0 || p.Threshold > 1 {
+		return errors.New("threshold must be between 0 and 1")
+	}
+
+	if p.Interval <= 0 {
+		p.Interval = duration(time.Second * 2)
+	}
+	if p.Cooldown <= 0 {
+		p.Cooldown = duration(time.Minute)
+	}
+
+	return nil
+}
+
+func (svr *server) handleGetFailover(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetFailover")
+	defer log.Println("[END] handleGetFailover")
+
+	svr.failover.mu.Lock()
+	defer svr.failover.mu.Unlock()
+
+	resp := failoverResponse{
+		Policy: svr.failover.policy,
+		Health: svr.failover.health,
+		Events: svr.failover.events,
+	}
+	if !svr.failover.unhealthySince.IsZero() {
+		resp.UnhealthySince = &svr.failover.unhealthySince
+	}
+	if !svr.failover.lastFailover.IsZero() {
+		resp.LastFailover = &svr.failover.lastFailover
+	}
+
+	return errhandler.SendJSON(w, resp)
+}
+
+func (svr *server) handleSetFailover(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSetFailover")
+	defer log.Println("[END] handleSetFailover")
+
+	var req failoverPolicy
+	if err := errhandler.ParseJSON(r, &req); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	if err := req.validate(); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	svr.failover.mu.Lock()
+	defer svr.failover.mu.Unlock()
+
+	if svr.failover.stop != nil {
+		close(svr.failover.stop)
+		svr.failover.stop = nil
+	}
+
+	svr.failover.policy = req
+	svr.failover.unhealthySince = time.Time{}
+	svr.failover.warned = false
+
+	if req.Enabled {
+		svr.failover.stop = make(chan struct{})
+		go svr.monitorFailover(req, svr.failover.stop)
+	}
+
+	log.Printf("[SET] failover: %+v", req)
+	return nil
+}
+
+func (svr *server) monitorFailover(policy failoverPolicy, stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(policy.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			svr.checkFailover(policy)
+		}
+	}
+}
+
+func (svr *server) checkFailover(policy failoverPolicy) {
+	svr.serversMu.RLock()
+	if svr.blueGreen == nil {
+		svr.serversMu.RUnlock()
+		return
+	}
+	roles := *svr.blueGreen
+	live := svr.groupBackends(roles.Live)
+	standby := svr.groupBackends(roles.Standby)
+	svr.serversMu.RUnlock()
+
+	timeout := time.Duration(policy.Interval) / 2
+	health := probeHealth(live, timeout)
+
+	if !svr.failoverDue(policy, roles, health) {
+		return
+	}
+
+	// The standby is probed and the arbiter called without holding f.mu, so
+	// they don't hold up the failover endpoints.
+	standbyHealth := probeHealth(standby, timeout)
+
+	var arbiterErr error
+	if standbyHealth >= policy.Threshold && policy.Arbiter != "" {
+		req := confirmRequest{
+			Live:      roles.Live,
+			Standby:   roles.Standby,
+			Servers:   lo.Map(live, func(b backend, _ int) string { return b.server }),
+			Health:    health,
+			Threshold: policy.Threshold,
+		}
+		arbiterErr = confirmFailover(policy.Arbiter, svr.failover.arbiterToken, req)
+	}
+
+	f := svr.failover
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The policy may have been replaced in the meantime, starting over.
+	if f.policy != policy || f.unhealthySince.IsZero() {
+		return
+	}
+
+	if standbyHealth < policy.Threshold {
+		if !f.warned {
+			f.event("not promoting standby group %q, it's also unhealthy (health %.2f)", roles.Standby, standbyHealth)
+			f.warned = true
+		}
+		return
+	}
+
+	if arbiterErr != nil {
+		if !f.warned {
+			f.event("not promoting standby group %q, arbiter disagreed: %v", roles.Standby, arbiterErr)
+			f.warned = true
+		}
+		return
+	}
+
+	if !svr.promoteStandby(roles) {
+		return
+	}
+
+	f.lastFailover = time.Now()
+	f.unhealthySince = time.Time{}
+	f.warned = false
+	f.event("promoted standby group %q to live after %q was unhealthy for %s", roles.Standby, roles.Live, time.Duration(policy.For))
+}
+
+// failoverDue records the live group's health, returning true once it's
+// been unhealthy for long enough (and outside the cooldown) to fail over.
+func (svr *server) failoverDue(policy failoverPolicy, roles blueGreen, health float64) bool {
+	f := svr.failover
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.health = health
+
+	if health >= policy.Threshold {
+		if !f.unhealthySince.IsZero() {
+			msg := f.event("live group %q recovered (health %.2f)", roles.Live, health)
+			svr.events.publish(event{Kind: eventHealth, Groups: []string{roles.Live}, Message: msg})
+		}
+		f.unhealthySince = time.Time{}
+		f.warned = false
+		return false
+	}
+
+	if f.unhealthySince.IsZero() {
+		f.unhealthySince = time.Now()
+		msg := f.event("live group %q unhealthy (health %.2f)", roles.Live, health)
+		svr.events.publish(event{Kind: eventHealth, Groups: []string{roles.Live}, Message: msg})
+	}
+
+	if time.Since(f.unhealthySince) < time.Duration(policy.For) {
+		return false
+	}
+
+	return f.lastFailover.IsZero() || time.Since(f.lastFailover) >= time.Duration(policy.Cooldown)
+}
+
+// confirmFailover asks the arbiter to agree to a failover, authenticating
+// with token if there is one (as another dp's confirm endpoint needs).
+func confirmFailover(arbiter, token string, req confirmRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshalling confirm request: %w", err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, arbiter, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating confirm request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := http.Client{Timeout: time.Second * 5}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("calling arbiter: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("arbiter responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// handleConfirmFailover lets this dp act as the arbiter for another: it
+// agrees to a failover only if it also sees the live servers as unhealthy.
+func (svr *server) handleConfirmFailover(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleConfirmFailover")
+	defer log.Println("[END] handleConfirmFailover")
+
+	var req confirmRequest
+	if err := errhandler.ParseJSON(r, &req); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	backends := lo.Map(req.Servers, func(s string, _ int) backend { return backend{group: req.Live, server: s} })
+	health := probeHealth(backends, time.Second*2)
+
+	if health >= req.Threshold {
+		return errhandler.Error(http.StatusConflict, fmt.Errorf("live group %q is healthy from here (health %.2f)", req.Live, health))
+	}
+
+	log.Printf("[CONFIRM] live group %q is unhealthy from here too (health %.2f)", req.Live, health)
+	return nil
+}
+
+// promoteStandby swaps the blue/green roles, as long as they haven't changed
+// since they were read.
+func (svr *server) promoteStandby(roles blueGreen) bool {
+	svr.serversMu.Lock()
+
+	if svr.blueGreen == nil || *svr.blueGreen != roles {
+		svr.serversMu.Unlock()
+		return false
+	}
+
+	svr.blueGreen.Live, svr.blueGreen.Standby = roles.Standby, roles.Live
+	svr.activateGroups([]string{svr.blueGreen.Live})
+
+	svr.serversMu.Unlock()
+
+	svr.terminate()
+	return true
+}
+
+// event records and logs a failover event, returning its message. The
+// caller must hold f.mu.
+func (f *failover) event(format string, args ...any) string {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("[FAILOVER] %s", msg)
+
+	f.events = append(f.events, failoverEvent{Time: time.Now(), Message: msg})
+	if len(f.events) > maxFailoverEvents {
+		f.events = f.events[len(f.events)-maxFailoverEvents:]
+	}
+
+	return msg
+}
+
+// probeHealth returns the fraction of backends that can be dialed.
+func probeHealth(backends []backend, timeout time.Duration) float64 {
+	if len(backends) == 0 {
+		return 0
+	}
+
+	var mu sync.Mutex
+	var healthy int
+
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b backend) {
+			defer wg.Done()
+
+			if probe(b, timeout) == nil {
+				mu.Lock()
+				healthy++
+				mu.Unlock()
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	return float64(healthy) / float64(len(backends))
+}
+
+func probe(b backend, timeout time.Duration) error {
+	if b.healthCheck != nil {
+		_, err := b.healthCheck.check(b, timeout)
+		return err
+	}
+
+	conn, err := dialServer(b, timeout)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// shapeQueueLength bounds how many chunks a shaped writer holds before
+	// applying backpressure to the reader.
+	shapeQueueLength = 64
+
+	// lossPenalty approximates the cost of a lost packet, which TCP turns
+	// into a retransmission after (at least) its minimum timeout.
+	lossPenalty = time.Millisecond * 200
+
+	// abortDrainTimeout bounds how long an aborted connection waits for
+	// the client to close its side.
+	abortDrainTimeout = time.Second * 5
+)
+
+// faults describes the network conditions injected into a group's
+// connections, letting demos model conditions such as a slow upload.
+type faults struct {
+	// Preset names the shaping profile the faults started from, if any.
+	Preset string `json:"preset,omitempty"`
+
+	// UpstreamLatency is added to data sent from clients to servers, and
+	// DownstreamLatency to data sent from servers to clients. Up to Jitter
+	// more is added at random.
+	UpstreamLatency   duration `json:"upstream_latency,omitempty"`
+	DownstreamLatency duration `json:"downstream_latency,omitempty"`
+	Jitter            duration `json:"jitter,omitempty"`
+
+	// UpstreamBandwidth and DownstreamBandwidth limit each connection's
+	// throughput in bytes per second.
+	UpstreamBandwidth   int64 `json:"upstream_bandwidth,omitempty"`
+	DownstreamBandwidth int64 `json:"downstream_bandwidth,omitempty"`
+
+	// Loss approximates packet loss as the chance of each write being held
+	// back as if it had to be retransmitted.
+	Loss float64 `json:"loss,omitempty"`
+
+	// Abort and Reset are the chances of a new connection being closed
+	// before it's proxied, with a FIN or a TCP RST respectively.
+	Abort float64 `json:"abort,omitempty"`
+	Reset float64 `json:"reset,omitempty"`
+
+	// Cuts cuts connections part way through their lifetime.
+	Cuts *cutFault `json:"cuts,omitempty"`
+}
+
+// shapingPresets are named profiles for common network conditions.
+var shapingPresets = map[string]faults{
+	"3g": {
+		UpstreamLatency:     duration(time.Millisecond * 100),
+		DownstreamLatency:   duration(time.Millisecond * 100),
+		Jitter:              duration(time.Millisecond * 30),
+		UpstreamBandwidth:   96 * 1024,
+		DownstreamBandwidth: 200 * 1024,
+		Loss:                0.01,
+	},
+	"adsl": {
+		UpstreamLatency:     duration(time.Millisecond * 20),
+		DownstreamLatency:   duration(time.Millisecond * 20),
+		Jitter:              duration(time.Millisecond * 5),
+		UpstreamBandwidth:   128 * 1024,
+		DownstreamBandwidth: 1024 * 1024,
+	},
+	"wan": {
+		UpstreamLatency:     duration(time.Millisecond * 140),
+		DownstreamLatency:   duration(time.Millisecond * 140),
+		Jitter:              duration(time.Millisecond * 10),
+		UpstreamBandwidth:   12 * 1024 * 1024,
+		DownstreamBandwidth: 12 * 1024 * 1024,
+		Loss:                0.001,
+	},
+	"satellite": {
+		UpstreamLatency:     duration(time.Millisecond * 300),
+		DownstreamLatency:   duration(time.Millisecond * 300),
+		Jitter:              duration(time.Millisecond * 50),
+		UpstreamBandwidth:   375 * 1024,
+		DownstreamBandwidth: 2 * 1024 * 1024,
+		Loss:                0.005,
+	},
+}
+
+func (f *faults) validate() error {
+	if f.UpstreamLatency < 0 || f.DownstreamLatency < 0 || f.Jitter < 0 {
+		return errors.New("latency and jitter can't be negative")
+	}
+	if f.UpstreamBandwidth < 0 || f.DownstreamBandwidth < 0 {
+		return errors.New("bandwidth can't be negative")
+	}
+	if f.Loss < 0 || f.Loss > 1 {
+		return errors.New("loss must be between 0 and 1")
+	}
+	if f.Abort < 0 || f.Reset < 0 || f.Abort+f.Reset > 1 {
+		return errors.New("abort and reset must be between 0 and 1, and add up to no more than 1")
+	}
+	if f.Cuts != nil {
+		return f.Cuts.validate()
+	}
+	return nil
+}
+
+// refuse decides whether a new connection is to be closed before it's
+// proxied, returning how (or an empty string if it isn't). Connections to be
+// reset are set up to send a RST when they're closed. Aborted connections
+// are sent a FIN straight away, then drained until the client closes its
+// side too, since closing a connection with unread data sends a RST.
+func (f *faults) refuse(client net.Conn) string {
+	if f == nil {
+		return ""
+	}
+
+	n := rand.Float64()
+	switch {
+	case n < f.Reset:
+		if tcp := tcpConn(client); tcp != nil {
+			// A zero linger makes closing the connection send a RST.
+			tcp.SetLinger(0)
+		}
+		return "reset"
+	case n < f.Reset+f.Abort:
+		if closeWrite(client) {
+			client.SetReadDeadline(time.Now().Add(abortDrainTimeout))
+			io.Copy(io.Discard, client)
+		}
+		return "aborted"
+	default:
+		return ""
+	}
+}
+
+func (f *faults) toServer(w io.Writer) io.Writer {
+	return f.shape(w, time.Duration(f.UpstreamLatency), f.UpstreamBandwidth)
+}
+
+func (f *faults) toClient(w io.Writer) io.Writer {
+	return f.shape(w, time.Duration(f.DownstreamLatency), f.DownstreamBandwidth)
+}
+
+// shape returns a writer that delivers everything written to it after the
+// given latency (plus any jitter and loss), at up to the given bandwidth.
+// Latency doesn't limit throughput.
+func (f *faults) shape(w io.Writer, latency time.Duration, bandwidth int64) io.Writer {
+	if latency <= 0 && f.Jitter <= 0 && f.Loss <= 0 && bandwidth <= 0 {
+		return w
+	}
+
+	sw := &shapedWriter{
+		w:       w,
+		latency: latency,
+		jitter:  time.Duration(f.Jitter),
+		loss:    f.Loss,
+		queue:   make(chan shapedChunk, shapeQueueLength),
+		done:    make(chan struct{}),
+	}
+	if bandwidth > 0 {
+		sw.limiter = rate.NewLimiter(rate.Limit(bandwidth), int(bandwidth))
+	}
+	go sw.run()
+
+	return sw
+}
+
+type shapedChunk struct {
+	p   []byte
+	due time.Time
+}
+
+type shapedWriter struct {
+	w       io.Writer
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+	limiter *rate.Limiter
+
+	queue   chan shapedChunk
+	done    chan struct{}
+	err     error
+	lastDue time.Time
+}
+
+func (sw *shapedWriter) Write(p []byte) (int, error) {
+	select {
+	case <-sw.done:
+		return 0, sw.err
+	default:
+	}
+
+	delay := sw.latency
+	if sw.jitter > 0 {
+		delay += rand.N(sw.jitter)
+	}
+	if sw.loss > 0 && rand.Float64() < sw.loss {
+		delay += lossPenalty
+	}
+
+	// Chunks are delivered in order, so one can't overtake another that
+	// drew a longer delay.
+	due := time.Now().Add(delay)
+	if due.Before(sw.lastDue) {
+		due = sw.lastDue
+	}
+	sw.lastDue = due
+
+	sw.queue <- shapedChunk{p: append([]byte(nil), p...), due: due}
+	return len(p), nil
+}
+
+func (sw *shapedWriter) run() {
+	for c := range sw.queue {
+		if sw.err != nil {
+			continue
+		}
+
+		time.Sleep(time.Until(c.due))
+		if err := sw.write(c.p); err != nil {
+			sw.err = err
+			close(sw.done)
+		}
+	}
+
+	if sw.err == nil {
+		close(sw.done)
+	}
+}
+
+// write writes p, in pieces no bigger than the limiter's burst if there is
+// one.
+func (sw *shapedWriter) write(p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if sw.limiter != nil {
+			n = min(n, sw.limiter.Burst())
+			sw.limiter.WaitN(context.Background(), n)
+		}
+
+		if _, err := sw.w.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// flush waits for everything written to be delivered. Nothing can be written
+// afterwards.
+func (sw *shapedWriter) flush() {
+	close(sw.queue)
+	<-sw.done
+}
+
+// flushWriter flushes w if it holds back data, so it's delivered before the
+// connection is closed.
+func flushWriter(w io.Writer) {
+	if f, ok := w.(interface{ flush() }); ok {
+		f.flush()
+	}
+}
+
+// setFaults sets (or with nil, clears) the faults injected into a group's
+// connections. Locked groups can't have faults injected.
+func (svr *server) setFaults(name string, f *faults) error {
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	g, ok := svr.serverGroups[name]
+	if !ok {
+		return errhandler.Error(http.StatusNotFound, fmt.Errorf("group %q not found", name))
+	}
+
+	if g.Locked {
+		return errhandler.Error(http.StatusConflict, fmt.Errorf("group %q is locked", name))
+	}
+
+	g.Faults = f
+	svr.serverGroups[name] = g
+	return nil
+}
+
+// parseFaults reads faults from a request body. If a preset is named, it's
+// used as the starting point and any other fields given override it.
+func parseFaults(r *http.Request) (*faults, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+
+	var named struct {
+		Preset string `json:"preset"`
+	}
+	if err = json.Unmarshal(body, &named); err != nil {
+		return nil, fmt.Errorf("parsing request: %w", err)
+	}
+
+	var f faults
+	if named.Preset != "" {
+		preset, ok := shapingPresets[named.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q", named.Preset)
+		}
+		f = preset
+	}
+
+	if err = json.Unmarshal(body, &f); err != nil {
+		return nil, fmt.Errorf("parsing request: %w", err)
+	}
+
+	if err = f.validate(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (svr *server) handleSetFaults(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSetFaults")
+	defer log.Println("[END] handleSetFaults")
+
+	group := r.PathValue("group")
+
+	f, err := parseFaults(r)
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	log.Printf("[SET] faults: %q upstream latency: %s downstream latency: %s jitter: %s upstream bandwidth: %d downstream bandwidth: %d loss: %g",
+		group, time.Duration(f.UpstreamLatency), time.Duration(f.DownstreamLatency), time.Duration(f.Jitter), f.UpstreamBandwidth, f.DownstreamBandwidth, f.Loss)
+
+	return svr.setFaults(group, f)
+}
+
+func (svr *server) handleDeleteFaults(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleDeleteFaults")
+	defer log.Println("[END] handleDeleteFaults")
+
+	return svr.setFaults(r.PathValue("group"), nil)
+}
+
+type presetResponse struct {
+	Name string `json:"name"`
+	faults
+}
+
+func (svr *server) handleGetPresets(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetPresets")
+	defer log.Println("[END] handleGetPresets")
+
+	presets := make([]presetResponse, 0, len(shapingPresets))
+	for name, f := range shapingPresets {
+		presets = append(presets, presetResponse{Name: name, faults: f})
+	}
+
+	sort.Slice(presets, func(i, j int) bool {
+		return presets[i].Name < presets[j].Name
+	})
+
+	return errhandler.SendJSON(w, presets)
+}
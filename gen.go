@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type generator struct {
+	addr   string
+	hold   time.Duration
+	pgwire bool
+	user   string
+	tag    string
+
+	opened int64
+	failed int64
+}
+
+func runGen(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	host := fs.String("host", "localhost", "host of the proxy to generate traffic against")
+	port := fs.Int("port", 26257, "port number of the proxy to generate traffic against")
+	rate := fs.Int("rate", 50, "number of connections to open per second")
+	duration := fs.Duration("duration", time.Minute, "how long to generate traffic for")
+	hold := fs.Duration("hold", time.Second, "how long to hold each connection open")
+	pgwire := fs.Bool("pgwire", false, "send a pgwire startup message on each connection")
+	user := fs.String("user", "root", "user to send in the pgwire startup message")
+	tag := fs.String("tag", "", "tag to identify connections with via a dp preamble")
+	fs.Parse(args)
+
+	if *rate <= 0 {
+		log.Fatalf("rate must be greater than zero")
+	}
+
+	g := generator{
+		addr:   net.JoinHostPort(*host, fmt.Sprintf("%d", *port)),
+		hold:   *hold,
+		pgwire: *pgwire,
+		user:   *user,
+		tag:    *tag,
+	}
+
+	log.Printf("generating %d connections/s against %s for %s", *rate, g.addr, *duration)
+	g.run(*rate, *duration)
+	log.Printf("opened: %d failed: %d", g.opened, g.failed)
+}
+
+func (g *generator) run(rate int, duration time.Duration) {
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	deadline := time.After(duration)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-deadline:
+			return
+		case <-ticker.C:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.connect()
+			}()
+		}
+	}
+}
+
+func (g *generator) connect() {
+	conn, err := net.DialTimeout("tcp", g.addr, time.Second*5)
+	if err != nil {
+		atomic.AddInt64(&g.failed, 1)
+		return
+	}
+	defer conn.Close()
+
+	if g.tag != "" {
+		if _, err = fmt.Fprintf(conn, "%stag=%s\n", preambleMagic, g.tag); err != nil {
+			atomic.AddInt64(&g.failed, 1)
+			return
+		}
+	}
+
+	if g.pgwire {
+		if err = g.startup(conn); err != nil {
+			atomic.AddInt64(&g.failed, 1)
+			return
+		}
+	}
+
+	atomic.AddInt64(&g.opened, 1)
+	time.Sleep(g.hold)
+}
+
+// startup sends a minimal pgwire StartupMessage and waits for the first
+// message back from the server, which is enough for the connection to be
+// counted by a backend.
+func (g *generator) startup(conn net.Conn) error {
+	var params []byte
+	params = append(params, "user\x00"+g.user+"\x00"...)
+	params = append(params, "application_name\x00dp gen\x00"...)
+	params = append(params, 0)
+
+	msg := make([]byte, 8, 8+len(params))
+	binary.BigEndian.PutUint32(msg[0:4], uint32(8+len(params)))
+	binary.BigEndian.PutUint32(msg[4:8], pgProtocolVersion3)
+	msg = append(msg, params...)
+
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("writing startup message: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	defer conn.SetReadDeadline(time.Time{})
+
+	resp := make([]byte, 1)
+	if _, err := conn.Read(resp); err != nil {
+		return fmt.Errorf("reading startup response: %w", err)
+	}
+
+	if resp[0] == 'E' {
+		return fmt.Errorf("server rejected startup message")
+	}
+
+	return nil
+}
@@ -4,7 +4,14 @@ go 1.22.4
 
 require (
 	github.com/codingconcepts/errhandler v0.0.5
+	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/samber/lo v1.47.0
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/time v0.6.0
 )
 
-require golang.org/x/text v0.16.0 // indirect
+require (
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+)
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheck probes a group's servers over HTTP (e.g. CockroachDB's
+// /health?ready=1) instead of just dialing them. Servers failing their
+// last check are taken out of rotation until they pass again.
+type healthCheck struct {
+	Path string `json:"path"`
+
+	// Port is the HTTP port to probe, which defaults to the server's own
+	// port.
+	Port           int      `json:"port,omitempty"`
+	Scheme         string   `json:"scheme,omitempty"`
+	Interval       duration `json:"interval,omitempty"`
+	Timeout        duration `json:"timeout,omitempty"`
+	ExpectedStatus int      `json:"expected_status,omitempty"`
+}
+
+type healthResult struct {
+	Healthy   bool      `json:"healthy"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// healthChecks holds the latest result for each server, by group.
+type healthChecks struct {
+	mu      sync.RWMutex
+	results map[string]map[string]healthResult
+	next    map[string]time.Time
+}
+
+func newHealthChecks() *healthChecks {
+	return &healthChecks{
+		results: map[string]map[string]healthResult{},
+		next:    map[string]time.Time{},
+	}
+}
+
+// validate fills in defaults and checks the health check is usable.
+func (hc *healthCheck) validate() error {
+	if !strings.HasPrefix(hc.Path, "/") {
+		return errors.New("health check path must start with /")
+	}
+
+	switch hc.Scheme {
+	case "":
+		hc.Scheme = "http"
+	case "http", "https":
+	default:
+		return fmt.Errorf("invalid health check scheme %q", hc.Scheme)
+	}
+
+	if hc.Port < 0 || hc.Port > 65535 {
+		return fmt.Errorf("invalid health check port %d", hc.Port)
+	}
+	if hc.Interval == 0 {
+		hc.Interval = duration(time.Second * 5)
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = duration(time.Second * 2)
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return errors.New("health check interval and timeout must be positive")
+	}
+	if hc.ExpectedStatus == 0 {
+		hc.ExpectedStatus = http.StatusOK
+	}
+
+	return nil
+}
+
+// check makes a single health check request against a backend.
+func (hc *healthCheck) check(b backend, timeout time.Duration) (int, error) {
+	host, port, err := net.SplitHostPort(b.server)
+	if err != nil {
+		return 0, err
+	}
+	if hc.Port != 0 {
+		port = strconv.Itoa(hc.Port)
+	}
+
+	transport := &http.Transport{DisableKeepAlives: true}
+	if b.egress != nil {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return b.egress.dial(addr)
+		}
+	}
+
+	client := http.Client{Timeout: timeout, Transport: transport}
+	resp, err := client.Get(fmt.Sprintf("%s://%s%s", hc.Scheme, net.JoinHostPort(host, port), hc.Path))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != hc.ExpectedStatus {
+		return resp.StatusCode, fmt.Errorf("expected status %d, got %d", hc.ExpectedStatus, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// runHealthChecks checks each group with a health check as often as its
+// interval asks for.
+func (svr *server) runHealthChecks() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		svr.serversMu.RLock()
+		due := map[string][]backend{}
+		intervals := map[string]time.Duration{}
+		for name, g := range svr.serverGroups {
+			if g.HealthCheck != nil && g.Template == "" {
+				due[name] = svr.groupBackends(name)
+				intervals[name] = time.Duration(g.HealthCheck.Interval)
+			}
+		}
+		svr.serversMu.RUnlock()
+
+		h := svr.health
+		h.mu.Lock()
+		for name := range h.results {
+			if _, ok := due[name]; !ok {
+				delete(h.results, name)
+				delete(h.next, name)
+			}
+		}
+		for name := range due {
+			if now.Before(h.next[name]) {
+				delete(due, name)
+				continue
+			}
+			h.next[name] = now.Add(intervals[name])
+		}
+		h.mu.Unlock()
+
+		for name, backends := range due {
+			go svr.checkGroupHealth(name, backends)
+		}
+	}
+}
+
+func (svr *server) checkGroupHealth(name string, backends []backend) {
+	var mu sync.Mutex
+	results := map[string]healthResult{}
+
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b backend) {
+			defer wg.Done()
+
+			status, err := b.healthCheck.check(b, time.Duration(b.healthCheck.Timeout))
+			result := healthResult{Healthy: err == nil, Status: status, CheckedAt: time.Now()}
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			results[b.server] = result
+			mu.Unlock()
+		}(b)
+	}
+	wg.Wait()
+
+	h := svr.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for server, result := range results {
+		if last, ok := h.results[name][server]; !ok || last.Healthy != result.Healthy {
+			log.Printf("[HEALTH] group %q server %s healthy: %t", name, server, result.Healthy)
+		}
+	}
+	h.results[name] = results
+}
+
+// healthy returns false if a server failed its group's last health check.
+// Servers that haven't been checked yet are assumed to be healthy.
+func (h *healthChecks) healthy(b backend) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result, ok := h.results[b.group][b.server]
+	return !ok || result.Healthy
+}
+
+// groupResults returns a copy of the latest results for a group.
+func (h *healthChecks) groupResults(name string) map[string]healthResult {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	results, ok := h.results[name]
+	if !ok {
+		return nil
+	}
+
+	copied := make(map[string]healthResult, len(results))
+	for k, v := range results {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+const hookTimeout = time.Second * 10
+
+// activationHooks run whenever the active groups change, so state outside
+// dp (such as a demo table recording which region is live) can be kept in
+// sync with routing. Webhooks are set through the control API, while
+// commands can only be given on the command line. The veto hook, asked about
+// each connection, is kept alongside them.
+type activationHooks struct {
+	commands []string
+
+	mu       sync.Mutex
+	webhooks []string
+	veto     *vetoHook
+}
+
+// vetoHook is asked about every connection before its server is dialed, and
+// can reject it (e.g. while an external maintenance flag is set).
+type vetoHook struct {
+	URL     string   `json:"url"`
+	Timeout duration `json:"timeout,omitempty"`
+
+	// FailOpen allows connections when the hook can't be reached, rather
+	// than rejecting them.
+	FailOpen bool `json:"fail_open,omitempty"`
+}
+
+// vetoRequest describes a connection to a veto hook. Responding with
+// anything other than a 2xx rejects the connection, with the response body
+// as the reason.
+type vetoRequest struct {
+	ID     string `json:"id"`
+	Client string `json:"client"`
+	Group  string `json:"group"`
+	Server string `json:"server"`
+	Tag    string `json:"tag,omitempty"`
+}
+
+type hooksResponse struct {
+	Webhooks []string  `json:"webhooks"`
+	Commands []string  `json:"commands"`
+	Veto     *vetoHook `json:"veto,omitempty"`
+}
+
+type setHooksRequest struct {
+	Webhooks []string  `json:"webhooks"`
+	Veto     *vetoHook `json:"veto"`
+}
+
+// runActivationHooks runs the hooks for every activation and drain.
+func (svr *server) runActivationHooks() {
+	sub := svr.events.subscribe(16, eventActivation, eventDrain)
+
+	for e := range sub.c {
+		// Per-server drains don't change which groups are active.
+		if len(e.Servers) > 0 {
+			continue
+		}
+
+		svr.hooks.run(e)
+	}
+}
+
+func (h *activationHooks) run(e event) {
+	h.mu.Lock()
+	webhooks := h.webhooks
+	h.mu.Unlock()
+
+	for _, u := range webhooks {
+		if err := callWebhook(u, e); err != nil {
+			log.Printf("error calling activation webhook %s: %v", u, err)
+		}
+	}
+
+	for _, c := range h.commands {
+		if out, err := runHookCommand(c, e); err != nil {
+			log.Printf("error running activation command %q: %v: %s", c, err, out)
+		}
+	}
+}
+
+func callWebhook(u string, e event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshalling event: %w", err)
+	}
+
+	client := http.Client{Timeout: hookTimeout}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("calling webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// runHookCommand runs a command through the shell, passing the event in
+// DP_EVENT and the active groups (comma-separated) in DP_GROUPS.
+func runHookCommand(command string, e event) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := shellCommandContext(ctx, command)
+	cmd.Env = append(os.Environ(),
+		"DP_EVENT="+string(e.Kind),
+		"DP_GROUPS="+strings.Join(e.Groups, ","),
+	)
+
+	return cmd.CombinedOutput()
+}
+
+// shellCommand returns a command that runs through the shell.
+func shellCommand(command string) *exec.Cmd {
+	return shellCommandContext(context.Background(), command)
+}
+
+func shellCommandContext(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+func (svr *server) handleGetHooks(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetHooks")
+	defer log.Println("[END] handleGetHooks")
+
+	h := svr.hooks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return errhandler.SendJSON(w, hooksResponse{
+		Webhooks: append([]string{}, h.webhooks...),
+		Commands: append([]string{}, h.commands...),
+		Veto:     h.veto,
+	})
+}
+
+func (svr *server) handleSetHooks(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSetHooks")
+	defer log.Println("[END] handleSetHooks")
+
+	var req setHooksRequest
+	if err := errhandler.ParseJSON(r, &req); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	for _, u := range req.Webhooks {
+		if !validWebhook(u) {
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("invalid webhook url %q", u))
+		}
+	}
+
+	if req.Veto != nil {
+		if !validWebhook(req.Veto.URL) {
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("invalid veto url %q", req.Veto.URL))
+		}
+		if req.Veto.Timeout < 0 {
+			return errhandler.Error(http.StatusUnprocessableEntity, errors.New("veto timeout must not be negative"))
+		}
+		if req.Veto.Timeout == 0 {
+			req.Veto.Timeout = duration(time.Second)
+		}
+	}
+
+	log.Printf("[SET] activation webhooks: %v veto: %+v", req.Webhooks, req.Veto)
+
+	h := svr.hooks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.webhooks = req.Webhooks
+	h.veto = req.Veto
+	return nil
+}
+
+func validWebhook(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
+}
+
+// vetoConnection asks the veto hook (if there is one) whether a connection
+// can go ahead, returning an error giving the reason if it can't.
+func (h *activationHooks) vetoConnection(req vetoRequest) error {
+	h.mu.Lock()
+	veto := h.veto
+	h.mu.Unlock()
+
+	if veto == nil {
+		return nil
+	}
+
+	err := veto.ask(req)
+	var rejected *vetoRejection
+	if err == nil || errors.As(err, &rejected) || !veto.FailOpen {
+		return err
+	}
+
+	log.Printf("error calling veto hook, allowing connection: %v", err)
+	return nil
+}
+
+// vetoRejection is returned when the veto hook rejects a connection.
+type vetoRejection struct {
+	reason string
+}
+
+func (r *vetoRejection) Error() string {
+	return fmt.Sprintf("vetoed: %s", r.reason)
+}
+
+func (v *vetoHook) ask(req vetoRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshalling veto request: %w", err)
+	}
+
+	client := http.Client{Timeout: time.Duration(v.Timeout)}
+	resp, err := client.Post(v.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("calling veto hook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	reason, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if len(bytes.TrimSpace(reason)) == 0 {
+		reason = []byte(resp.Status)
+	}
+	return &vetoRejection{reason: string(bytes.TrimSpace(reason))}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// idempotencyCache replays the responses of successful requests carrying an
+// Idempotency-Key header, so retried automation calls don't repeat their
+// side effects. A key can only be reused with the same request body, so a
+// client reusing a key for a different change is told rather than being
+// handed the earlier response.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+type idempotentResponse struct {
+	bodyHash [sha256.Size]byte
+
+	done    chan struct{}
+	ok      bool
+	expires time.Time
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	c := &idempotencyCache{
+		ttl:     ttl,
+		entries: map[string]*idempotentResponse{},
+	}
+
+	go c.cleanup()
+	return c
+}
+
+func (c *idempotencyCache) middleware(next errhandler.Wrap) errhandler.Wrap {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			return next(w, r)
+		}
+		key = r.Method + " " + r.URL.Path + " " + key
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return errhandler.Error(http.StatusBadRequest, fmt.Errorf("reading request: %w", err))
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := sha256.Sum256(body)
+
+		for {
+			entry, owner := c.claim(key, bodyHash)
+			if owner {
+				return c.run(key, entry, next, w, r)
+			}
+			if entry.bodyHash != bodyHash {
+				return errhandler.Error(http.StatusUnprocessableEntity, errors.New("idempotency key was already used with a different request body"))
+			}
+
+			<-entry.done
+			if entry.ok {
+				entry.replay(w)
+				return nil
+			}
+			// The original request failed, so this one is free to try again.
+		}
+	}
+}
+
+// claim returns the entry for the key, and whether the caller now owns it
+// and should run the request.
+func (c *idempotencyCache) claim(key string, bodyHash [sha256.Size]byte) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok && (entry.expires.IsZero() || time.Now().Before(entry.expires)) {
+		return entry, false
+	}
+
+	entry := &idempotentResponse{bodyHash: bodyHash, done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true
+}
+
+func (c *idempotencyCache) run(key string, entry *idempotentResponse, next errhandler.Wrap, w http.ResponseWriter, r *http.Request) error {
+	// The entry is settled however the request ends, including by panicking
+	// (which is recovered further out), so retries waiting on it don't block
+	// forever.
+	settled := false
+	defer func() {
+		if !settled {
+			c.settle(key, entry, nil)
+		}
+	}()
+
+	rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	err := next(rec, r)
+	settled = true
+
+	if err != nil {
+		c.settle(key, entry, nil)
+		return err
+	}
+
+	c.settle(key, entry, rec)
+	entry.replay(w)
+	return nil
+}
+
+// settle stores a request's response for replaying, or if it failed (rec is
+// nil), frees the key for the next request to try again.
+func (c *idempotencyCache) settle(key string, entry *idempotentResponse, rec *responseRecorder) {
+	c.mu.Lock()
+	if rec == nil {
+		delete(c.entries, key)
+	} else {
+		entry.ok = true
+		entry.expires = time.Now().Add(c.ttl)
+		entry.status = rec.status
+		entry.header = rec.header
+		entry.body = rec.body.Bytes()
+	}
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+func (e *idempotentResponse) replay(w http.ResponseWriter) {
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+func (c *idempotencyCache) cleanup() {
+	for range time.Tick(time.Minute) {
+		c.mu.Lock()
+		for key, entry := range c.entries {
+			if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// responseRecorder captures a handler's response so it can be cached.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	return rr.body.Write(p)
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// serverListHeaders are the first-column names a header row can have.
+var serverListHeaders = []string{"server", "servers", "address", "addr", "host"}
+
+// parseServerList reads addresses (host:port, or bare hosts to be given the
+// group's port) from a newline-separated list or a CSV file, taking the
+// first column of each record. Blank lines and lines starting with "#" are
+// skipped, as is a header row naming the column.
+func parseServerList(r io.Reader) ([]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+
+	var servers []string
+	for i := 0; ; i++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading server list: %w", err)
+		}
+
+		addr := strings.TrimSpace(record[0])
+		if addr == "" {
+			continue
+		}
+
+		if i == 0 && slices.Contains(serverListHeaders, strings.ToLower(addr)) {
+			continue
+		}
+
+		if !validServerAddr(addr) {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("line %d: invalid server %q, must be a host or host:port", line, addr)
+		}
+
+		servers = append(servers, addr)
+	}
+
+	if len(servers) == 0 {
+		return nil, errors.New("no servers found")
+	}
+
+	return servers, nil
+}
+
+// validServerAddr returns true if addr is a host:port, or a bare IP or DNS
+// name.
+func validServerAddr(addr string) bool {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return true
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	return net.ParseIP(host) != nil || validDNSName(host)
+}
+
+// handleImportServers creates or updates a group from a pasted list of
+// servers, keeping the rest of an existing group's configuration.
+func (svr *server) handleImportServers(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleImportServers")
+	defer log.Println("[END] handleImportServers")
+
+	name := r.PathValue("group")
+
+	servers, err := parseServerList(r.Body)
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	req := setGroupRequest{Name: name, Servers: servers}
+
+	svr.serversMu.RLock()
+	if g, ok := svr.serverGroups[name]; ok {
+		req.Egress = g.Egress
+		req.Protocol = g.Protocol
+		req.RetryError = g.RetryError
+		req.HealthCheck = g.HealthCheck
+		req.Port = g.Port
+		req.Compression = g.Compression
+		req.Balance = g.Balance
+	}
+	svr.serversMu.RUnlock()
+
+	if req.Servers, err = svr.resolveServers(req.Servers, req.Port); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	log.Printf("[IMPORT] group: %q servers: %v", name, req.Servers)
+
+	if err = svr.setGroup(req); err != nil {
+		return errhandler.Error(http.StatusConflict, err)
+	}
+
+	return errhandler.SendJSON(w, req.Servers)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// inheritedFirstFD is the first file descriptor sockets are passed
+	// from (systemd's SD_LISTEN_FDS_START, and the first of ExtraFiles).
+	inheritedFirstFD = 3
+
+	listenerProxy   = "proxy"
+	listenerControl = "control"
+)
+
+// inheritedFDsEnv names the sockets passed to dp by dp bind, which binds
+// privileged ports before starting dp as an unprivileged user.
+const inheritedFDsEnv = "DP_LISTEN_FDS"
+
+// inheritedListeners returns the listening sockets passed to dp, by name,
+// either by systemd socket activation or by dp bind. Sockets are named with
+// FileDescriptorName= ("proxy" or "control"), or if they aren't named, the
+// first is taken to be the proxy port and the second the control port.
+func inheritedListeners() (map[string]net.Listener, error) {
+	if v, ok := os.LookupEnv(inheritedFDsEnv); ok {
+		os.Unsetenv(inheritedFDsEnv)
+
+		names := strings.Split(v, ":")
+		return listenersFromFDs(len(names), names)
+	}
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	// Don't pass the sockets on to hook commands.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return listenersFromFDs(count, names)
+}
+
+func listenersFromFDs(count int, names []string) (map[string]net.Listener, error) {
+	defaults := []string{listenerProxy, listenerControl}
+
+	listeners := map[string]net.Listener{}
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) && (names[i] == listenerProxy || names[i] == listenerControl) {
+			name = names[i]
+		} else if i < len(defaults) {
+			name = defaults[i]
+		}
+		if name == "" || listeners[name] != nil {
+			return nil, fmt.Errorf("unexpected inherited socket %d", i)
+		}
+
+		f := os.NewFile(uintptr(inheritedFirstFD+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("using inherited %s socket: %w", name, err)
+		}
+
+		listeners[name] = l
+	}
+
+	return listeners, nil
+}
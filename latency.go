@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+const (
+	latencyWindow  = time.Second * 10
+	latencyWindows = 60
+)
+
+// latencyBounds are the upper bounds of each latency bucket, the final bucket
+// catches everything above the last bound.
+var latencyBounds = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 2,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 25,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+}
+
+type latencyHistograms struct {
+	mu     sync.Mutex
+	groups map[string][]latencyColumn
+}
+
+// latencyColumn holds the counts for a single window, along with the ID of
+// the most recent connection in each bucket as an exemplar.
+type latencyColumn struct {
+	Time      time.Time `json:"time"`
+	Counts    []int     `json:"counts"`
+	Exemplars []string  `json:"exemplars"`
+}
+
+type latencyResponse struct {
+	Buckets []string                   `json:"buckets"`
+	Groups  map[string][]latencyColumn `json:"groups"`
+}
+
+func newLatencyHistograms() *latencyHistograms {
+	return &latencyHistograms{
+		groups: map[string][]latencyColumn{},
+	}
+}
+
+func (lh *latencyHistograms) record(group, id string, d time.Duration) {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+
+	window := time.Now().Truncate(latencyWindow)
+
+	columns := lh.groups[group]
+	if len(columns) == 0 || !columns[len(columns)-1].Time.Equal(window) {
+		columns = append(columns, latencyColumn{
+			Time:      window,
+			Counts:    make([]int, len(latencyBounds)+1),
+			Exemplars: make([]string, len(latencyBounds)+1),
+		})
+	}
+
+	if len(columns) > latencyWindows {
+		columns = columns[len(columns)-latencyWindows:]
+	}
+
+	i := sort.Search(len(latencyBounds), func(i int) bool {
+		return d <= latencyBounds[i]
+	})
+	columns[len(columns)-1].Counts[i]++
+	columns[len(columns)-1].Exemplars[i] = id
+
+	lh.groups[group] = columns
+}
+
+func (lh *latencyHistograms) snapshot() latencyResponse {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+
+	resp := latencyResponse{
+		Groups: map[string][]latencyColumn{},
+	}
+
+	for _, b := range latencyBounds {
+		resp.Buckets = append(resp.Buckets, b.String())
+	}
+	resp.Buckets = append(resp.Buckets, "+Inf")
+
+	for g, columns := range lh.groups {
+		for _, c := range columns {
+			resp.Groups[g] = append(resp.Groups[g], latencyColumn{
+				Time:      c.Time,
+				Counts:    append([]int(nil), c.Counts...),
+				Exemplars: append([]string(nil), c.Exemplars...),
+			})
+		}
+	}
+
+	return resp
+}
+
+func (svr *server) handleGetLatency(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetLatency")
+	defer log.Println("[END] handleGetLatency")
+
+	return errhandler.SendJSON(w, svr.latency.snapshot())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+const (
+	listenerPending = "pending"
+	listenerBound   = "bound"
+)
+
+// listenerState reports whether the proxy port has been bound yet, so dp can
+// start while a previous owner of the port is still exiting.
+type listenerState struct {
+	mu sync.Mutex
+
+	State     string     `json:"state"`
+	Addr      string     `json:"addr"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	BoundAt   *time.Time `json:"bound_at,omitempty"`
+}
+
+// listen binds addr, retrying with exponential backoff for up to retryFor if
+// the address is in use.
+func (l *listenerState) listen(addr string, retryFor time.Duration) (net.Listener, error) {
+	l.mu.Lock()
+	l.State = listenerPending
+	l.Addr = addr
+	l.mu.Unlock()
+
+	return bindWithRetry(addr, retryFor, func() (net.Listener, error) {
+		listener, err := net.Listen("tcp", addr)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.Attempts++
+		if err == nil {
+			now := time.Now()
+			l.State = listenerBound
+			l.LastError = ""
+			l.BoundAt = &now
+		} else {
+			l.LastError = err.Error()
+		}
+
+		return listener, err
+	})
+}
+
+// bindWithRetry calls bind until it succeeds, retrying with exponential
+// backoff for up to retryFor.
+func bindWithRetry(addr string, retryFor time.Duration, bind func() (net.Listener, error)) (net.Listener, error) {
+	deadline := time.Now().Add(retryFor)
+	backoff := time.Millisecond * 100
+
+	for {
+		listener, err := bind()
+		if err == nil {
+			return listener, nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+
+		log.Printf("error binding %s, retrying in %s: %v", addr, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Second*5)
+	}
+}
+
+// inherit records a listener that was bound by something else (e.g. passed
+// by systemd).
+func (l *listenerState) inherit(listener net.Listener) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.State = listenerBound
+	l.Addr = listener.Addr().String()
+	l.BoundAt = &now
+}
+
+func (svr *server) handleGetListener(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetListener")
+	defer log.Println("[END] handleGetListener")
+
+	l := svr.listener
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return errhandler.SendJSON(w, l)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// setLocked sets whether a group is locked. Locked groups can still be
+// activated but can't be redefined or deleted until they're unlocked.
+func (svr *server) setLocked(name string, locked bool) error {
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	g, ok := svr.serverGroups[name]
+	if !ok {
+		return fmt.Errorf("group %q not found", name)
+	}
+
+	g.Locked = locked
+	svr.serverGroups[name] = g
+	return nil
+}
+
+func (svr *server) handleLockGroup(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleLockGroup")
+	defer log.Println("[END] handleLockGroup")
+
+	group := r.PathValue("group")
+
+	if err := svr.setLocked(group, true); err != nil {
+		return errhandler.Error(http.StatusNotFound, err)
+	}
+
+	log.Printf("locked group %q", group)
+	return nil
+}
+
+func (svr *server) handleUnlockGroup(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleUnlockGroup")
+	defer log.Println("[END] handleUnlockGroup")
+
+	group := r.PathValue("group")
+
+	if err := svr.setLocked(group, false); err != nil {
+		return errhandler.Error(http.StatusNotFound, err)
+	}
+
+	log.Printf("unlocked group %q", group)
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const protocolMySQL = "mysql"
+
+const (
+	mysqlClientSSL          = 0x00000800
+	mysqlClientDeprecateEOF = 0x01000000
+	mysqlMoreResultsExists  = 0x0008
+	mysqlMaxPacketLength    = 0xffffff
+
+	mysqlComQuit           = 0x01
+	mysqlComQuery          = 0x03
+	mysqlComBinlogDump     = 0x12
+	mysqlComStmtPrepare    = 0x16
+	mysqlComStmtExecute    = 0x17
+	mysqlComStmtSendLong   = 0x18
+	mysqlComStmtClose      = 0x19
+	mysqlComStmtFetch      = 0x1c
+	mysqlComBinlogDumpGTID = 0x1e
+)
+
+type mysqlState int
+
+const (
+	mysqlFirstPacket mysqlState = iota
+	mysqlColumns
+	mysqlColumnsEOF
+	mysqlRows
+	mysqlCounting
+	mysqlStreaming
+)
+
+// mysqlWatcher follows the MySQL command phase closely enough to tell when a
+// command's response has been fully sent, so a terminated connection can be
+// closed between commands and sent ER_SERVER_SHUTDOWN. TLS sessions are left
+// alone, as dp passes TLS through rather than terminating it.
+type mysqlWatcher struct {
+	mu sync.Mutex
+
+	client mysqlPackets
+	server mysqlPackets
+
+	encrypted    bool
+	commandPhase bool
+	deprecateEOF bool
+	draining     bool
+
+	busy      bool
+	cmd       byte
+	state     mysqlState
+	remaining int
+}
+
+func (mw *mysqlWatcher) toServer(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		mw.mu.Lock()
+		draining := mw.draining
+		if !draining {
+			mw.client.feed(p, mw.clientPacket)
+		}
+		mw.mu.Unlock()
+
+		if draining {
+			return 0, errDraining
+		}
+
+		return w.Write(p)
+	})
+}
+
+func (mw *mysqlWatcher) toClient(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		n, err := w.Write(p)
+
+		mw.mu.Lock()
+		mw.server.feed(p[:n], mw.serverPacket)
+		mw.mu.Unlock()
+
+		return n, err
+	})
+}
+
+func (mw *mysqlWatcher) idle() bool {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	return !mw.busy
+}
+
+// shutdown waits for the current command to finish before closing the server
+// side and telling the client the server is shutting down.
+func (mw *mysqlWatcher) shutdown(client, server net.Conn, serverDone <-chan struct{}) {
+	mw.mu.Lock()
+	mw.draining = true
+	mw.mu.Unlock()
+
+	if !waitIdle(mw.idle, serverDone) {
+		return
+	}
+
+	server.Close()
+	<-serverDone
+
+	mw.mu.Lock()
+	writable := mw.commandPhase && !mw.encrypted && !mw.busy
+	mw.mu.Unlock()
+
+	if !writable {
+		return
+	}
+
+	client.SetWriteDeadline(time.Now().Add(time.Second))
+	client.Write(mysqlServerShutdown())
+}
+
+func (mw *mysqlWatcher) clientPacket(seq byte, length int, prefix []byte) {
+	if mw.encrypted {
+		return
+	}
+
+	if !mw.commandPhase {
+		// The handshake response (or SSL request) carries the capability
+		// flags, and the first packet starting a new sequence is the first
+		// command.
+		if seq != 0 {
+			if len(prefix) >= 4 {
+				flags := binary.LittleEndian.Uint32(prefix)
+				mw.encrypted = flags&mysqlClientSSL != 0
+				mw.deprecateEOF = flags&mysqlClientDeprecateEOF != 0
+			}
+			return
+		}
+		mw.commandPhase = true
+	}
+
+	// Packets continuing a command (such as LOAD DATA file contents) aren't
+	// commands themselves.
+	if seq != 0 || len(prefix) == 0 {
+		return
+	}
+
+	mw.cmd = prefix[0]
+	switch mw.cmd {
+	case mysqlComQuit, mysqlComStmtSendLong, mysqlComStmtClose:
+		// No response.
+		mw.busy = false
+	default:
+		mw.busy = true
+		mw.state = mysqlFirstPacket
+	}
+}
+
+func (mw *mysqlWatcher) serverPacket(seq byte, length int, prefix []byte) {
+	if mw.encrypted || !mw.busy || len(prefix) == 0 {
+		return
+	}
+
+	header := prefix[0]
+
+	switch mw.state {
+	case mysqlFirstPacket:
+		switch mw.cmd {
+		case mysqlComQuery, mysqlComStmtExecute:
+			switch header {
+			case 0x00, 0xff:
+				mw.endResult(length, prefix)
+			case 0xfb:
+				// LOCAL INFILE request; the client sends the file and the
+				// server finishes with an OK.
+			default:
+				mw.remaining = int(mysqlLenEnc(prefix))
+				mw.state = mysqlColumns
+			}
+		case mysqlComStmtPrepare:
+			if header != 0x00 || len(prefix) < 9 {
+				mw.busy = false
+				return
+			}
+			columns := int(binary.LittleEndian.Uint16(prefix[5:7]))
+			params := int(binary.LittleEndian.Uint16(prefix[7:9]))
+
+			mw.remaining = columns + params
+			if !mw.deprecateEOF {
+				mw.remaining += min(columns, 1) + min(params, 1)
+			}
+			mw.state = mysqlCounting
+			mw.busy = mw.remaining > 0
+		case mysqlComStmtFetch:
+			mw.state = mysqlRows
+			mw.serverPacket(seq, length, prefix)
+		case mysqlComBinlogDump, mysqlComBinlogDumpGTID:
+			mw.state = mysqlStreaming
+		default:
+			mw.busy = false
+		}
+	case mysqlColumns:
+		if mw.remaining--; mw.remaining <= 0 {
+			mw.state = mysqlRows
+			if !mw.deprecateEOF {
+				mw.state = mysqlColumnsEOF
+			}
+		}
+	case mysqlColumnsEOF:
+		mw.state = mysqlRows
+	case mysqlRows:
+		if header == 0xff || (header == 0xfe && length < mysqlMaxPacketLength) {
+			mw.endResult(length, prefix)
+		}
+	case mysqlCounting:
+		if mw.remaining--; mw.remaining <= 0 {
+			mw.busy = false
+		}
+	}
+}
+
+// endResult finishes the command, unless the server says more result sets
+// follow.
+func (mw *mysqlWatcher) endResult(length int, prefix []byte) {
+	var status uint16
+	switch {
+	case prefix[0] == 0xff:
+	case prefix[0] == 0xfe && length < 9 && !mw.deprecateEOF:
+		// EOF: header, warnings, status flags.
+		if len(prefix) >= 5 {
+			status = binary.LittleEndian.Uint16(prefix[3:5])
+		}
+	default:
+		// OK: header, affected rows, last insert ID, status flags.
+		rest := prefix[1:]
+		rest = rest[mysqlLenEncSize(rest):]
+		rest = rest[mysqlLenEncSize(rest):]
+		if len(rest) >= 2 {
+			status = binary.LittleEndian.Uint16(rest)
+		}
+	}
+
+	if status&mysqlMoreResultsExists != 0 {
+		mw.state = mysqlFirstPacket
+		return
+	}
+
+	mw.busy = false
+}
+
+// mysqlPackets splits a stream into MySQL packets, keeping just the start of
+// each payload.
+type mysqlPackets struct {
+	header    []byte
+	seq       byte
+	length    int
+	remaining int
+	prefix    []byte
+	continued bool
+}
+
+const mysqlPrefixLength = 32
+
+func (mp *mysqlPackets) feed(p []byte, fn func(seq byte, length int, prefix []byte)) {
+	for len(p) > 0 {
+		if len(mp.header) < 4 {
+			n := min(4-len(mp.header), len(p))
+			mp.header = append(mp.header, p[:n]...)
+			p = p[n:]
+			if len(mp.header) < 4 {
+				return
+			}
+
+			mp.length = int(mp.header[0]) | int(mp.header[1])<<8 | int(mp.header[2])<<16
+			mp.seq = mp.header[3]
+			mp.remaining = mp.length
+			mp.prefix = mp.prefix[:0]
+		}
+
+		n := min(mp.remaining, len(p))
+		if len(mp.prefix) < mysqlPrefixLength {
+			mp.prefix = append(mp.prefix, p[:min(n, mysqlPrefixLength-len(mp.prefix))]...)
+		}
+		mp.remaining -= n
+		p = p[n:]
+
+		if mp.remaining == 0 {
+			// Payloads of the maximum length continue in the next packet.
+			if !mp.continued {
+				fn(mp.seq, mp.length, mp.prefix)
+			}
+			mp.continued = mp.length == mysqlMaxPacketLength
+			mp.header = mp.header[:0]
+		}
+	}
+}
+
+// mysqlLenEncSize returns the size of the length-encoded integer at the start
+// of b.
+func mysqlLenEncSize(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+
+	var size int
+	switch b[0] {
+	case 0xfc:
+		size = 3
+	case 0xfd:
+		size = 4
+	case 0xfe:
+		size = 9
+	default:
+		size = 1
+	}
+
+	return min(size, len(b))
+}
+
+func mysqlLenEnc(b []byte) uint64 {
+	size := mysqlLenEncSize(b)
+	if size == 1 {
+		return uint64(b[0])
+	}
+
+	var v uint64
+	for i := size - 1; i >= 1; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+// mysqlServerShutdown returns an ER_SERVER_SHUTDOWN error packet, sent as the
+// response to the client's next command.
+func mysqlServerShutdown() []byte {
+	payload := []byte{0xff}
+	payload = binary.LittleEndian.AppendUint16(payload, 1053)
+	payload = append(payload, "#08S01"...)
+	payload = append(payload, "Server shutdown in progress"...)
+
+	packet := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 1}
+	return append(packet, payload...)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// mysqlPacket builds a packet with the given sequence ID and payload.
+func mysqlPacket(seq byte, payload []byte) []byte {
+	packet := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	return append(packet, payload...)
+}
+
+type mysqlSeen struct {
+	seq    byte
+	length int
+	prefix []byte
+}
+
+// feedPackets feeds reads to a framer, returning the packets it reports.
+func feedPackets(reads ...[]byte) []mysqlSeen {
+	var mp mysqlPackets
+	var seen []mysqlSeen
+	for _, p := range reads {
+		mp.feed(p, func(seq byte, length int, prefix []byte) {
+			seen = append(seen, mysqlSeen{seq: seq, length: length, prefix: bytes.Clone(prefix)})
+		})
+	}
+	return seen
+}
+
+func checkPackets(t *testing.T, got, expected []mysqlSeen) {
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("got %d packets, expected %d", len(got), len(expected))
+	}
+	for i := range expected {
+		if got[i].seq != expected[i].seq || got[i].length != expected[i].length || !bytes.Equal(got[i].prefix, expected[i].prefix) {
+			t.Fatalf("packet %d: got seq %d, length %d, prefix %q, expected seq %d, length %d, prefix %q",
+				i, got[i].seq, got[i].length, got[i].prefix, expected[i].seq, expected[i].length, expected[i].prefix)
+		}
+	}
+}
+
+func TestMySQLPacketsSplitReads(t *testing.T) {
+	query := append([]byte{mysqlComQuery}, "SELECT 1"...)
+	stream := bytes.Join([][]byte{
+		mysqlPacket(0, query),
+		mysqlPacket(1, nil),
+		mysqlPacket(2, []byte{0xfe, 0, 0, 2, 0}),
+	}, nil)
+
+	expected := []mysqlSeen{
+		{seq: 0, length: len(query), prefix: query},
+		{seq: 1, length: 0, prefix: []byte{}},
+		{seq: 2, length: 5, prefix: []byte{0xfe, 0, 0, 2, 0}},
+	}
+
+	for split := 0; split <= len(stream); split++ {
+		checkPackets(t, feedPackets(stream[:split], stream[split:]), expected)
+	}
+
+	var reads [][]byte
+	for i := range stream {
+		reads = append(reads, stream[i:i+1])
+	}
+	checkPackets(t, feedPackets(reads...), expected)
+}
+
+func TestMySQLPacketsThreeByteLength(t *testing.T) {
+	// Each byte of the length is significant.
+	payload := bytes.Repeat([]byte{'x'}, 0x012345)
+	packet := mysqlPacket(3, payload)
+
+	expected := []mysqlSeen{{seq: 3, length: 0x012345, prefix: payload[:mysqlPrefixLength]}}
+
+	for _, split := range []int{1, 2, 3, 4, 5, len(packet) / 2, len(packet) - 1} {
+		checkPackets(t, feedPackets(packet[:split], packet[split:]), expected)
+	}
+}
+
+func TestMySQLPacketsMaxLengthContinuation(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, mysqlMaxPacketLength)
+
+	// The continuation starts like an EOF packet, which mustn't be taken
+	// as the end of a result set.
+	continuation := []byte{0xfe, 0, 0, 2, 0}
+	next := []byte{mysqlComQuery}
+
+	cases := []struct {
+		name  string
+		reads [][]byte
+	}{
+		{
+			name: "continued by a short packet",
+			reads: [][]byte{
+				mysqlPacket(0, payload),
+				mysqlPacket(1, continuation),
+				mysqlPacket(0, next),
+			},
+		},
+		{
+			name: "continued by an empty packet",
+			reads: [][]byte{
+				mysqlPacket(0, payload),
+				mysqlPacket(1, nil),
+				mysqlPacket(0, next),
+			},
+		},
+		{
+			name: "coalesced",
+			reads: [][]byte{bytes.Join([][]byte{
+				mysqlPacket(0, payload),
+				mysqlPacket(1, continuation),
+				mysqlPacket(0, next),
+			}, nil)},
+		},
+	}
+
+	expected := []mysqlSeen{
+		{seq: 0, length: mysqlMaxPacketLength, prefix: payload[:mysqlPrefixLength]},
+		{seq: 0, length: len(next), prefix: next},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			checkPackets(t, feedPackets(c.reads...), expected)
+		})
+	}
+
+	t.Run("continued by another max length packet", func(t *testing.T) {
+		got := feedPackets(
+			mysqlPacket(0, payload),
+			mysqlPacket(1, payload),
+			mysqlPacket(2, continuation),
+			mysqlPacket(0, next),
+		)
+		checkPackets(t, got, expected)
+	})
+}
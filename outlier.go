@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const maxEjectionBackoff = time.Minute * 5
+
+// outliers ejects servers that repeatedly fail to dial, so new clients stop
+// being sent to them during an incident. Each ejection lasts twice as long
+// as the last, until a dial to the server succeeds again.
+type outliers struct {
+	after   int
+	backoff time.Duration
+
+	mu      sync.Mutex
+	servers map[string]*outlier
+}
+
+type outlier struct {
+	failures int
+	backoff  time.Duration
+	until    time.Time
+}
+
+// ejection describes a server that's out of rotation.
+type ejection struct {
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+func newOutliers(after int, backoff time.Duration) *outliers {
+	return &outliers{
+		after:   after,
+		backoff: backoff,
+		servers: map[string]*outlier{},
+	}
+}
+
+// record records the result of dialing a server.
+func (o *outliers) record(server string, err error) {
+	if o.after <= 0 {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err == nil {
+		if _, ok := o.servers[server]; ok {
+			log.Printf("[OUTLIER] %s recovered", server)
+			delete(o.servers, server)
+		}
+		return
+	}
+
+	s, ok := o.servers[server]
+	if !ok {
+		s = &outlier{}
+		o.servers[server] = s
+	}
+	s.failures++
+
+	// Servers are let back in once an ejection is over, so a failure after
+	// that ejects them again straight away.
+	if s.failures < o.after && s.backoff == 0 {
+		return
+	}
+	if time.Now().Before(s.until) {
+		return
+	}
+
+	if s.backoff == 0 {
+		s.backoff = o.backoff
+	} else {
+		s.backoff = min(s.backoff*2, maxEjectionBackoff)
+	}
+	s.until = time.Now().Add(s.backoff)
+
+	log.Printf("[OUTLIER] ejecting %s for %s after %d failed dials: %v", server, s.backoff, s.failures, err)
+}
+
+// ejected returns true if a server is currently out of rotation.
+func (o *outliers) ejected(server string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s, ok := o.servers[server]
+	return ok && time.Now().Before(s.until)
+}
+
+// ejection returns a server's current ejection.
+func (o *outliers) ejection(server string) *ejection {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s, ok := o.servers[server]
+	if !ok || !time.Now().Before(s.until) {
+		return nil
+	}
+	return &ejection{Failures: s.failures, Until: s.until}
+}
+
+// groupEjections returns the current ejections of a group's servers.
+func (o *outliers) groupEjections(servers []string) map[string]ejection {
+	var ejections map[string]ejection
+	for _, s := range servers {
+		if e := o.ejection(s); e != nil {
+			if ejections == nil {
+				ejections = map[string]ejection{}
+			}
+			ejections[s] = *e
+		}
+	}
+	return ejections
+}
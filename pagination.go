@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// page holds the limit, offset and name prefix accepted by list endpoints.
+// The number of matching items before paging is returned in the
+// X-Total-Count header, so responses keep their shape.
+type page struct {
+	limit  int
+	offset int
+	prefix string
+}
+
+func parsePage(r *http.Request) (page, error) {
+	q := r.URL.Query()
+	p := page{prefix: q.Get("prefix")}
+
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if p.limit, err = strconv.Atoi(v); err != nil || p.limit < 0 {
+			return page{}, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if p.offset, err = strconv.Atoi(v); err != nil || p.offset < 0 {
+			return page{}, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+
+	return p, nil
+}
+
+func (p page) matches(name string) bool {
+	return strings.HasPrefix(name, p.prefix)
+}
+
+// paginate returns the page of items, having set the X-Total-Count header.
+func paginate[T any](w http.ResponseWriter, p page, items []T) []T {
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+
+	if p.offset >= len(items) {
+		return items[:0]
+	}
+	items = items[p.offset:]
+
+	if p.limit > 0 && p.limit < len(items) {
+		items = items[:p.limit]
+	}
+	return items
+}
+
+// parseBoolFilter parses an optional true/false query parameter.
+func parseBoolFilter(r *http.Request, name string) (*bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return &b, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// panicCounters counts the panics recovered from control API handlers and
+// proxied connections.
+type panicCounters struct {
+	handlers    atomic.Int64
+	connections atomic.Int64
+}
+
+type panicsResponse struct {
+	Handlers    int64 `json:"handlers"`
+	Connections int64 `json:"connections"`
+}
+
+// recoverHandler stops a panicking control API handler taking the process
+// down, logging it with the request's ID and a stack trace.
+func (svr *server) recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			// Let net/http deal with deliberately aborted responses.
+			if err, ok := rec.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(rec)
+			}
+
+			svr.panics.handlers.Add(1)
+			log.Printf("[%s] panic in %s %s: %v\n%s", requestID(r), r.Method, r.URL.Path, rec, debug.Stack())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverConn stops a panic in one of a proxied connection's goroutines
+// taking the process down, logging it with the connection's ID and a stack
+// trace and closing the connection. It must be deferred directly.
+func (svr *server) recoverConn(id string, closers ...io.Closer) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+
+	svr.panics.connections.Add(1)
+	log.Printf("[%s] panic in connection: %v\n%s", id, rec, debug.Stack())
+
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+func (svr *server) handleGetPanics(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetPanics")
+	defer log.Println("[END] handleGetPanics")
+
+	return errhandler.SendJSON(w, panicsResponse{
+		Handlers:    svr.panics.handlers.Load(),
+		Connections: svr.panics.connections.Load(),
+	})
+}
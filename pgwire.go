@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const protocolPgwire = "pgwire"
+
+const (
+	pgProtocolVersion3  = 196608
+	pgSSLRequestCode    = 80877103
+	pgGSSENCRequestCode = 80877104
+	pgCancelRequestCode = 80877102
+)
+
+// pgwireWatcher looks at the start of a client's pgwire stream to work out
+// whether dp can safely write protocol messages to it, and follows the
+// server's messages so it only writes between them. Encrypted sessions are
+// left alone, as dp passes TLS through rather than terminating it.
+type pgwireWatcher struct {
+	mu        sync.Mutex
+	first     []byte
+	encrypted bool
+	draining  bool
+	server    pgMessages
+}
+
+func (pw *pgwireWatcher) toServer(w io.Writer) io.Writer {
+	return &pgwireWriter{w: w, pw: pw}
+}
+
+// toClient stops forwarding once the connection's draining and the server
+// has finished the message it was sending.
+func (pw *pgwireWatcher) toClient(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		pw.mu.Lock()
+		send := len(p)
+		if pw.draining {
+			next := pw.server
+			send = next.feed(p, true)
+		}
+		pw.mu.Unlock()
+
+		n, err := w.Write(p[:send])
+
+		pw.mu.Lock()
+		pw.server.feed(p[:n], false)
+		pw.mu.Unlock()
+
+		if err == nil && send < len(p) {
+			err = errDraining
+		}
+		return n, err
+	})
+}
+
+// idle returns whether the server's between messages, or sending something
+// that can't be followed, so there's no boundary to wait for.
+func (pw *pgwireWatcher) idle() bool {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	return pw.server.boundary() || pw.server.malformed
+}
+
+type pgwireWriter struct {
+	w  io.Writer
+	pw *pgwireWatcher
+}
+
+func (pww *pgwireWriter) Write(p []byte) (int, error) {
+	pww.pw.observe(p)
+	return pww.w.Write(p)
+}
+
+func (pw *pgwireWatcher) observe(p []byte) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if len(pw.first) >= 8 {
+		return
+	}
+
+	pw.first = append(pw.first, p[:min(len(p), 8-len(pw.first))]...)
+	if len(pw.first) < 8 {
+		return
+	}
+
+	switch binary.BigEndian.Uint32(pw.first[4:8]) {
+	case pgSSLRequestCode, pgGSSENCRequestCode:
+		pw.encrypted = true
+	}
+}
+
+// shutdown waits for the server to finish the message it's sending, then
+// stops traffic from the server and tells the client that the server is
+// shutting down (SQLSTATE 57P01), so drivers reconnect straight away rather
+// than surfacing an unexpected EOF. If the server doesn't finish its message
+// in time, the connection's closed without the error.
+func (pw *pgwireWatcher) shutdown(client, server net.Conn, serverDone <-chan struct{}) {
+	pw.mu.Lock()
+	writable := len(pw.first) >= 8 && !pw.encrypted
+	pw.draining = writable
+	pw.mu.Unlock()
+
+	if !writable || !waitIdle(pw.idle, serverDone) {
+		return
+	}
+
+	// Wait for the server side to stop writing, so the error isn't
+	// interleaved with a message from the server.
+	server.Close()
+	<-serverDone
+
+	pw.mu.Lock()
+	writable = pw.server.boundary()
+	pw.mu.Unlock()
+
+	if !writable {
+		return
+	}
+
+	client.SetWriteDeadline(time.Now().Add(time.Second))
+	client.Write(pgAdminShutdown())
+}
+
+// pgMessages follows the message framing of a pgwire stream from the server
+// (a type byte and a length, then the rest of the message).
+type pgMessages struct {
+	header    [5]byte
+	headerLen int
+	remaining int
+	malformed bool
+}
+
+// boundary returns whether the stream is between messages.
+func (pm *pgMessages) boundary() bool {
+	return !pm.malformed && pm.headerLen == 0 && pm.remaining == 0
+}
+
+// feed follows p, returning how much of it was consumed, which is all of it
+// unless stop is set, in which case it stops at the first boundary. Streams
+// that stop making sense are consumed in full.
+func (pm *pgMessages) feed(p []byte, stop bool) int {
+	consumed := 0
+	for consumed < len(p) && !pm.malformed {
+		if stop && pm.boundary() {
+			break
+		}
+
+		if pm.remaining == 0 {
+			n := copy(pm.header[pm.headerLen:], p[consumed:])
+			pm.headerLen += n
+			consumed += n
+			if pm.headerLen < len(pm.header) {
+				continue
+			}
+
+			length := int(binary.BigEndian.Uint32(pm.header[1:5]))
+			if length < 4 {
+				pm.malformed = true
+				break
+			}
+			pm.headerLen = 0
+			pm.remaining = length - 4
+			continue
+		}
+
+		n := min(pm.remaining, len(p)-consumed)
+		pm.remaining -= n
+		consumed += n
+	}
+
+	if pm.malformed {
+		return len(p)
+	}
+	return consumed
+}
+
+func pgAdminShutdown() []byte {
+	var fields []byte
+	fields = append(fields, 'S')
+	fields = append(fields, "FATAL\x00"...)
+	fields = append(fields, 'V')
+	fields = append(fields, "FATAL\x00"...)
+	fields = append(fields, 'C')
+	fields = append(fields, "57P01\x00"...)
+	fields = append(fields, 'M')
+	fields = append(fields, "terminating connection due to administrator command\x00"...)
+	fields = append(fields, 0)
+
+	msg := make([]byte, 5, 5+len(fields))
+	msg[0] = 'E'
+	binary.BigEndian.PutUint32(msg[1:5], uint32(4+len(fields)))
+
+	return append(msg, fields...)
+}
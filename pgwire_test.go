@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pgMessage builds a server message of the given type and body.
+func pgMessage(typ byte, body string) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:5], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// pgStartup builds an unencrypted client startup message.
+func pgStartup() []byte {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg[0:4], 8)
+	binary.BigEndian.PutUint32(msg[4:8], pgProtocolVersion3)
+	return msg
+}
+
+func TestPgMessagesFraming(t *testing.T) {
+	rowDescription := pgMessage('T', "row description")
+	dataRow := pgMessage('D', "data row")
+	ready := pgMessage('Z', "I")
+	stream := bytes.Join([][]byte{rowDescription, dataRow, ready}, nil)
+
+	cases := []struct {
+		name      string
+		reads     [][]byte
+		boundary  bool
+		malformed bool
+	}{
+		{
+			name:     "coalesced messages",
+			reads:    [][]byte{stream},
+			boundary: true,
+		},
+		{
+			name:     "byte at a time",
+			reads:    splitEvery(stream, 1),
+			boundary: true,
+		},
+		{
+			name:     "header split across reads",
+			reads:    [][]byte{dataRow[:3], dataRow[3:]},
+			boundary: true,
+		},
+		{
+			name:     "body split across reads",
+			reads:    [][]byte{dataRow[:7], dataRow[7:]},
+			boundary: true,
+		},
+		{
+			name:  "message and part of the next",
+			reads: [][]byte{append(append([]byte{}, dataRow...), ready[:2]...)},
+		},
+		{
+			name:  "header only",
+			reads: [][]byte{dataRow[:5]},
+		},
+		{
+			name:      "length shorter than itself",
+			reads:     [][]byte{{'D', 0, 0, 0, 3}, ready},
+			malformed: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var pm pgMessages
+			for _, p := range c.reads {
+				if n := pm.feed(p, false); n != len(p) {
+					t.Fatalf("consumed %d of %d bytes", n, len(p))
+				}
+			}
+
+			if pm.boundary() != c.boundary {
+				t.Fatalf("expected boundary %v", c.boundary)
+			}
+			if pm.malformed != c.malformed {
+				t.Fatalf("expected malformed %v", c.malformed)
+			}
+		})
+	}
+}
+
+func TestPgMessagesStopAtBoundary(t *testing.T) {
+	dataRow := pgMessage('D', "data row")
+	ready := pgMessage('Z', "I")
+
+	var pm pgMessages
+	pm.feed(dataRow[:7], false)
+
+	// Finishing the message and starting the next in one read should only
+	// consume the rest of the first message.
+	p := append(append([]byte{}, dataRow[7:]...), ready...)
+	if n := pm.feed(p, true); n != len(dataRow)-7 {
+		t.Fatalf("consumed %d bytes, expected %d", n, len(dataRow)-7)
+	}
+	if !pm.boundary() {
+		t.Fatal("expected a boundary")
+	}
+
+	if n := pm.feed(ready, true); n != 0 {
+		t.Fatalf("consumed %d bytes at a boundary", n)
+	}
+}
+
+func splitEvery(p []byte, n int) [][]byte {
+	var parts [][]byte
+	for len(p) > 0 {
+		size := min(n, len(p))
+		parts = append(parts, p[:size])
+		p = p[size:]
+	}
+	return parts
+}
+
+// pgwireSession wires a watcher to a client pipe, returning the client's end
+// so tests can read what's written to it.
+func pgwireSession(t *testing.T) (*pgwireWatcher, net.Conn, net.Conn, net.Conn) {
+	t.Helper()
+
+	client, clientEnd := net.Pipe()
+	server, serverEnd := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		clientEnd.Close()
+		server.Close()
+		serverEnd.Close()
+	})
+
+	pw := &pgwireWatcher{}
+	if _, err := pw.toServer(io.Discard).Write(pgStartup()); err != nil {
+		t.Fatalf("writing startup message: %v", err)
+	}
+
+	return pw, client, clientEnd, server
+}
+
+func waitDraining(pw *pgwireWatcher) {
+	for {
+		pw.mu.Lock()
+		draining := pw.draining
+		pw.mu.Unlock()
+		if draining {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readClient reads what's written to the client until it's closed or stops
+// sending.
+func readClient(conn net.Conn) []byte {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, _ := io.ReadAll(conn)
+	return b
+}
+
+func TestPgwireShutdownWaitsForBoundary(t *testing.T) {
+	pw, client, clientEnd, server := pgwireSession(t)
+
+	var forwarded bytes.Buffer
+	toClient := pw.toClient(&forwarded)
+
+	dataRow := pgMessage('D', "data row")
+	ready := pgMessage('Z', "I")
+	toClient.Write(dataRow[:7])
+
+	serverDone := make(chan struct{})
+	shutdown := make(chan struct{})
+	go func() {
+		pw.shutdown(client, server, serverDone)
+		client.Close()
+		close(shutdown)
+	}()
+
+	// The server finishes its message and starts the next in one read,
+	// which should be cut at the boundary.
+	waitDraining(pw)
+	p := append(append([]byte{}, dataRow[7:]...), ready...)
+	n, err := toClient.Write(p)
+	if !errors.Is(err, errDraining) {
+		t.Fatalf("expected errDraining, got %v", err)
+	}
+	if n != len(dataRow)-7 {
+		t.Fatalf("forwarded %d bytes, expected %d", n, len(dataRow)-7)
+	}
+	close(serverDone)
+
+	got := readClient(clientEnd)
+	<-shutdown
+
+	if !bytes.Equal(forwarded.Bytes(), dataRow) {
+		t.Fatalf("forwarded %q, expected %q", forwarded.Bytes(), dataRow)
+	}
+	if !bytes.Equal(got, pgAdminShutdown()) {
+		t.Fatalf("client got %q, expected the shutdown error", got)
+	}
+}
+
+func TestPgwireShutdownAtBoundary(t *testing.T) {
+	pw, client, clientEnd, server := pgwireSession(t)
+	pw.toClient(io.Discard).Write(pgMessage('Z', "I"))
+
+	serverDone := make(chan struct{})
+	close(serverDone)
+
+	go func() {
+		pw.shutdown(client, server, serverDone)
+		client.Close()
+	}()
+
+	if got := readClient(clientEnd); !bytes.Equal(got, pgAdminShutdown()) {
+		t.Fatalf("client got %q, expected the shutdown error", got)
+	}
+}
+
+func TestPgwireShutdownServerHangsUpMidMessage(t *testing.T) {
+	pw, client, clientEnd, server := pgwireSession(t)
+	pw.toClient(io.Discard).Write(pgMessage('D', "data row")[:7])
+
+	serverDone := make(chan struct{})
+	close(serverDone)
+
+	go func() {
+		pw.shutdown(client, server, serverDone)
+		client.Close()
+	}()
+
+	if got := readClient(clientEnd); len(got) > 0 {
+		t.Fatalf("client got %q mid-message", got)
+	}
+}
+
+func TestPgwireShutdownEncrypted(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	server, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer serverEnd.Close()
+
+	sslRequest := make([]byte, 8)
+	binary.BigEndian.PutUint32(sslRequest[0:4], 8)
+	binary.BigEndian.PutUint32(sslRequest[4:8], pgSSLRequestCode)
+
+	pw := &pgwireWatcher{}
+	pw.toServer(io.Discard).Write(sslRequest)
+
+	go func() {
+		pw.shutdown(client, server, make(chan struct{}))
+		client.Close()
+	}()
+
+	if got := readClient(clientEnd); len(got) > 0 {
+		t.Fatalf("client got %q on an encrypted session", got)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// pin sends clients matching a CIDR or tag to a fixed group (and optionally
+// a fixed server in it), whichever groups are active. If the server's out
+// of rotation, the client gets another of the group's servers.
+type pin struct {
+	CIDR   string `json:"cidr,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	Group  string `json:"group"`
+	Server string `json:"server,omitempty"`
+
+	network *net.IPNet
+}
+
+func (p *pin) validate() error {
+	if (p.CIDR == "") == (p.Tag == "") {
+		return errors.New("a pin needs either a cidr or a tag")
+	}
+	if p.Group == "" {
+		return errors.New("missing pin group")
+	}
+
+	if p.CIDR != "" {
+		network, err := parseNetwork(p.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid pin cidr: %w", err)
+		}
+		p.network = network
+	}
+
+	return nil
+}
+
+// parseNetwork parses a CIDR, treating a bare address as a network of one.
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+func (p pin) matches(ip net.IP, tag string) bool {
+	if p.network != nil {
+		return ip != nil && p.network.Contains(ip)
+	}
+	return tag != "" && p.Tag == tag
+}
+
+// pinFor returns the first pin matching a client.
+func (svr *server) pinFor(clientIP, tag string) (pin, bool) {
+	ip := net.ParseIP(clientIP)
+
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	for _, p := range svr.pins {
+		if p.matches(ip, tag) {
+			return p, true
+		}
+	}
+	return pin{}, false
+}
+
+func (svr *server) handleGetPins(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetPins")
+	defer log.Println("[END] handleGetPins")
+
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	return errhandler.SendJSON(w, append([]pin{}, svr.pins...))
+}
+
+// handleSetPins replaces every pin. Pins are checked in order, so the first
+// to match a client wins.
+func (svr *server) handleSetPins(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSetPins")
+	defer log.Println("[END] handleSetPins")
+
+	var req []pin
+	if err := errhandler.ParseJSON(r, &req); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	for i := range req {
+		if err := req[i].validate(); err != nil {
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("pin %d: %w", i, err))
+		}
+	}
+
+	log.Printf("[SET] pins: %+v", req)
+
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	svr.pins = req
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// routePluginTimeout is how long a connection waits for the route
+	// plugin's decision before it's routed as if there were no plugin.
+	routePluginTimeout = time.Second
+
+	// routePluginRestartDelay is how long dp waits before restarting a
+	// route plugin that's exited.
+	routePluginRestartDelay = time.Second
+
+	// routePluginBacklog is how many requests can be waiting to be written
+	// to the route plugin before connections stop asking it.
+	routePluginBacklog = 1024
+)
+
+// routePlugin delegates routing decisions to a long-running external
+// command, so bespoke logic can decide where connections go without forking
+// dp. Each connection is written to the command's stdin as a line of JSON,
+// and the command answers with a line of JSON on its stdout, matched to the
+// connection by its ID, so it can answer out of order. Connections are
+// routed as usual when the plugin doesn't answer in time or isn't running.
+type routePlugin struct {
+	command string
+
+	mu      sync.Mutex
+	proc    *pluginProcess
+	retryAt time.Time
+}
+
+type pluginProcess struct {
+	lines   chan []byte
+	pending map[string]chan routeDecision
+}
+
+// routeRequest describes a connection to the route plugin.
+type routeRequest struct {
+	ID     string   `json:"id"`
+	Client string   `json:"client"`
+	Tag    string   `json:"tag,omitempty"`
+	Groups []string `json:"groups"`
+}
+
+// routeDecision is the route plugin's answer for a connection. An empty
+// decision routes the connection as usual.
+type routeDecision struct {
+	ID string `json:"id"`
+
+	// Group sends the connection to one of the group's servers, whether or
+	// not it's active.
+	Group string `json:"group,omitempty"`
+
+	// Reject closes the connection, giving the reason.
+	Reject string `json:"reject,omitempty"`
+}
+
+func newRoutePlugin(command string) *routePlugin {
+	if command == "" {
+		return nil
+	}
+
+	return &routePlugin{command: command}
+}
+
+// route asks the plugin where a connection should go.
+func (p *routePlugin) route(req routeRequest) (routeDecision, error) {
+	if p == nil {
+		return routeDecision{}, nil
+	}
+
+	line, err := json.Marshal(req)
+	if err != nil {
+		return routeDecision{}, fmt.Errorf("marshalling route request: %w", err)
+	}
+
+	decided := make(chan routeDecision, 1)
+
+	p.mu.Lock()
+	if p.proc == nil {
+		if err = p.start(); err != nil {
+			p.mu.Unlock()
+			return routeDecision{}, err
+		}
+	}
+	proc := p.proc
+
+	select {
+	case proc.lines <- append(line, '\n'):
+		proc.pending[req.ID] = decided
+	default:
+		err = errors.New("route plugin isn't keeping up")
+	}
+	p.mu.Unlock()
+
+	if err != nil {
+		return routeDecision{}, err
+	}
+
+	select {
+	case d, ok := <-decided:
+		if !ok {
+			return routeDecision{}, errors.New("route plugin exited")
+		}
+		return d, nil
+	case <-time.After(routePluginTimeout):
+		p.mu.Lock()
+		delete(proc.pending, req.ID)
+		p.mu.Unlock()
+		return routeDecision{}, errors.New("timed out waiting for route plugin")
+	}
+}
+
+// start runs the plugin's command, unless it exited too recently to be
+// restarted. p.mu must be held.
+func (p *routePlugin) start() error {
+	if time.Now().Before(p.retryAt) {
+		return errors.New("route plugin is restarting")
+	}
+
+	cmd := shellCommand(p.command)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("opening route plugin stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("opening route plugin stdout: %w", err)
+	}
+
+	if err = cmd.Start(); err != nil {
+		p.retryAt = time.Now().Add(routePluginRestartDelay)
+		return fmt.Errorf("starting route plugin: %w", err)
+	}
+	log.Printf("started route plugin %q", p.command)
+
+	proc := &pluginProcess{
+		lines:   make(chan []byte, routePluginBacklog),
+		pending: map[string]chan routeDecision{},
+	}
+	p.proc = proc
+
+	go func() {
+		defer stdin.Close()
+		for line := range proc.lines {
+			if _, err := stdin.Write(line); err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			var d routeDecision
+			if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+				log.Printf("error parsing route plugin decision: %v", err)
+				continue
+			}
+
+			p.mu.Lock()
+			decided, ok := proc.pending[d.ID]
+			delete(proc.pending, d.ID)
+			p.mu.Unlock()
+
+			if ok {
+				decided <- d
+			}
+		}
+
+		log.Printf("route plugin exited: %v", cmd.Wait())
+		p.exited(proc)
+	}()
+
+	return nil
+}
+
+// exited fails the connections still waiting on a plugin process that's
+// exited, leaving the plugin to be restarted by the next connection.
+func (p *routePlugin) exited(proc *pluginProcess) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	close(proc.lines)
+	for _, decided := range proc.pending {
+		close(decided)
+	}
+	proc.pending = map[string]chan routeDecision{}
+
+	p.proc = nil
+	p.retryAt = time.Now().Add(routePluginRestartDelay)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// connLimit caps the number of connections the proxy port serves at once.
+// Connections over the cap are closed straight away, or if queueTimeout is
+// set, wait up to that long for another connection to close first. A max of
+// zero disables it.
+type connLimit struct {
+	max          int
+	queueTimeout time.Duration
+	slots        chan struct{}
+
+	queued int64
+	shed   int64
+}
+
+type portResponse struct {
+	Port           int      `json:"port"`
+	Addr           string   `json:"addr"`
+	Connections    int64    `json:"connections"`
+	SlotsInUse     *int     `json:"slots_in_use,omitempty"`
+	MaxConnections int      `json:"max_connections"`
+	QueueTimeout   duration `json:"queue_timeout"`
+	Queued         int64    `json:"queued"`
+	Shed           int64    `json:"shed"`
+}
+
+func newConnLimit(max int, queueTimeout time.Duration) *connLimit {
+	l := &connLimit{
+		max:          max,
+		queueTimeout: queueTimeout,
+	}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+
+	return l
+}
+
+// acquire takes a connection slot, queueing for one if the port is at its
+// cap, and returns false if the connection should be shed instead. Each
+// successful acquire must be followed by a release.
+func (l *connLimit) acquire() bool {
+	if l.slots == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queueTimeout > 0 {
+		atomic.AddInt64(&l.queued, 1)
+		defer atomic.AddInt64(&l.queued, -1)
+
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+
+		select {
+		case l.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	atomic.AddInt64(&l.shed, 1)
+	return false
+}
+
+func (l *connLimit) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (svr *server) handleGetPorts(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetPorts")
+	defer log.Println("[END] handleGetPorts")
+
+	svr.listener.mu.Lock()
+	addr := svr.listener.Addr
+	svr.listener.mu.Unlock()
+
+	// dp only has the one proxy port, but it's returned as a list so
+	// clients don't need to change if that ever changes.
+	// Slots (which include connections still being routed and dialed) are
+	// only taken when there's a limit.
+	l := svr.connLimit
+	var slots *int
+	if l.slots != nil {
+		inUse := len(l.slots)
+		slots = &inUse
+	}
+
+	connections, _ := svr.connections.snapshot()
+	return errhandler.SendJSON(w, []portResponse{
+		{
+			Port:           svr.port,
+			Addr:           addr,
+			Connections:    connections,
+			SlotsInUse:     slots,
+			MaxConnections: l.max,
+			QueueTimeout:   duration(l.queueTimeout),
+			Queued:         atomic.LoadInt64(&l.queued),
+			Shed:           atomic.LoadInt64(&l.shed),
+		},
+	})
+}
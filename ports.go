@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// resolveServers adds a port to servers given as bare hosts, using the
+// group's port or failing that, the default backend port. Servers that
+// already have a port are left alone.
+func (svr *server) resolveServers(servers []string, groupPort int) ([]string, error) {
+	port := groupPort
+	if port == 0 {
+		port = svr.backendPort
+	}
+
+	resolved := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err == nil {
+			resolved = append(resolved, s)
+			continue
+		}
+
+		if port == 0 {
+			return nil, fmt.Errorf("server %q has no port and there's no group or default backend port", s)
+		}
+
+		host := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		resolved = append(resolved, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	return resolved, nil
+}
+
+func validatePort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const preambleMagic = "DP1 "
+
+// peekLimits bound how much dp buffers, and for how long, while looking at
+// the start of a client's stream. Clients that exceed them are forwarded
+// untouched.
+type peekLimits struct {
+	maxBytes int
+	timeout  time.Duration
+}
+
+// preamble is what a client can ask for in its preamble line.
+type preamble struct {
+	tag string
+
+	// compression is set by another dp instance that wants the
+	// connection between the two compressed.
+	compression string
+}
+
+// readPreamble looks for an optional "DP1 tag=<tag>\n" line at the start of
+// a client's stream, stripping it and returning its fields if found.
+// Clients that don't send one (or send nothing because the server speaks
+// first) are passed through untouched.
+func readPreamble(client net.Conn, limits peekLimits) (net.Conn, preamble, error) {
+	br := bufio.NewReaderSize(client, max(limits.maxBytes, len(preambleMagic)))
+	conn := &bufferedConn{Conn: client, r: br}
+
+	client.SetReadDeadline(time.Now().Add(limits.timeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	magic, err := br.Peek(len(preambleMagic))
+	if err != nil {
+		if isTimeout(err) {
+			return conn, preamble{}, nil
+		}
+		return nil, preamble{}, fmt.Errorf("peeking preamble: %w", err)
+	}
+
+	if !bytes.Equal(magic, []byte(preambleMagic)) {
+		return conn, preamble{}, nil
+	}
+
+	// Peek a byte at a time until there's a full line, so nothing is consumed
+	// if the client goes over the limits.
+	for n := len(preambleMagic) + 1; n <= limits.maxBytes; n = br.Buffered() + 1 {
+		peeked, err := br.Peek(min(n, limits.maxBytes))
+		if i := bytes.IndexByte(peeked, '\n'); i >= 0 {
+			br.Discard(i + 1)
+			return conn, parsePreamble(string(peeked[:i])), nil
+		}
+
+		if err != nil {
+			if isTimeout(err) || errors.Is(err, bufio.ErrBufferFull) {
+				return conn, preamble{}, nil
+			}
+			return nil, preamble{}, fmt.Errorf("reading preamble: %w", err)
+		}
+	}
+
+	return conn, preamble{}, nil
+}
+
+func parsePreamble(line string) preamble {
+	var p preamble
+
+	fields := strings.Fields(strings.TrimPrefix(line, preambleMagic))
+	for _, f := range fields {
+		if tag, ok := strings.CutPrefix(f, "tag="); ok {
+			p.tag = tag
+		}
+		if compression, ok := strings.CutPrefix(f, "compress="); ok {
+			p.compression = compression
+		}
+	}
+	return p
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// preflight dials every server in the given groups and returns an error
+// describing each group that doesn't exist or doesn't have at least one
+// dialable server. Template groups can't be checked, as their addresses are
+// only known once a client connects, so they're returned as skipped.
+func (svr *server) preflight(groups []string, timeout time.Duration) ([]string, error) {
+	var failures, skipped []string
+
+	svr.serversMu.RLock()
+	servers := map[string][]backend{}
+	for _, g := range groups {
+		found, ok := svr.serverGroups[g]
+		switch {
+		case !ok:
+			failures = append(failures, fmt.Sprintf("%q (group not found)", g))
+		case found.Template != "":
+			skipped = append(skipped, g)
+		default:
+			servers[g] = []backend{}
+			for _, s := range found.Servers {
+				servers[g] = append(servers[g], backend{group: g, server: s, egress: found.Egress})
+			}
+		}
+	}
+	svr.serversMu.RUnlock()
+
+	var mu sync.Mutex
+
+	var wg sync.WaitGroup
+	for g, backends := range servers {
+		wg.Add(1)
+		go func(g string, backends []backend) {
+			defer wg.Done()
+
+			if errs, ok := dialAny(backends, timeout); !ok {
+				mu.Lock()
+				failures = append(failures, fmt.Sprintf("%q (%s)", g, strings.Join(errs, ", ")))
+				mu.Unlock()
+			}
+		}(g, backends)
+	}
+	wg.Wait()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return nil, fmt.Errorf("no dialable servers in groups: %s", strings.Join(failures, "; "))
+	}
+	return skipped, nil
+}
+
+// dialAny returns true if at least one of the servers can be dialed (through
+// their group's egress, if it has one) and the errors for those that can't.
+func dialAny(backends []backend, timeout time.Duration) ([]string, bool) {
+	var errs []string
+	for _, b := range backends {
+		if b.server == internalEcho {
+			return nil, true
+		}
+
+		conn, err := dialServer(b, timeout)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		conn.Close()
+		return nil, true
+	}
+
+	if len(errs) == 0 {
+		errs = append(errs, "group has no servers")
+	}
+	return errs, false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// protocolDrainTimeout is how long a terminated connection is given to finish
+// the commands already sent to the server.
+const protocolDrainTimeout = time.Second * 5
+
+// errDraining is returned by watchers that stop forwarding client commands
+// while draining, so the connection can reach a command boundary.
+var errDraining = errors.New("connection is draining")
+
+// protocolWatcher understands just enough of a wire protocol to end a
+// session cleanly when its connection is terminated.
+type protocolWatcher interface {
+	// toServer and toClient wrap the writers for each direction of the
+	// connection, letting the watcher observe the traffic.
+	toServer(w io.Writer) io.Writer
+	toClient(w io.Writer) io.Writer
+
+	// shutdown is called when the connection is terminated, before it's
+	// closed. serverDone is closed once nothing more will be copied from the
+	// server to the client.
+	shutdown(client, server net.Conn, serverDone <-chan struct{})
+}
+
+func newProtocolWatcher(b backend) protocolWatcher {
+	switch b.protocol {
+	case protocolPgwire:
+		return &pgwireWatcher{}
+	case protocolRESP:
+		return newRESPWatcher(b.retryError)
+	case protocolMySQL:
+		return &mysqlWatcher{}
+	default:
+		return nil
+	}
+}
+
+func validateProtocol(protocol string) error {
+	switch protocol {
+	case "", protocolPgwire, protocolRESP, protocolMySQL:
+		return nil
+	default:
+		return fmt.Errorf("invalid protocol %q, must be one of %q, %q or %q", protocol, protocolPgwire, protocolRESP, protocolMySQL)
+	}
+}
+
+// waitIdle waits for up to protocolDrainTimeout for idle to return true,
+// returning false if the server hangs up while it's busy. Watchers stop
+// forwarding at a boundary, which ends the copy from the server, so hanging
+// up while idle still counts.
+func waitIdle(idle func() bool, serverDone <-chan struct{}) bool {
+	deadline := time.Now().Add(protocolDrainTimeout)
+	for !idle() && time.Now().Before(deadline) {
+		select {
+		case <-serverDone:
+			return idle()
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	return true
+}
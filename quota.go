@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+var errQuotaExceeded = errors.New("byte quota exceeded")
+
+// clientUsageTTL is how long a client IP's usage is remembered after its
+// last connection closes.
+const clientUsageTTL = time.Hour
+
+// quotas tracks the bytes transferred by each client IP and enforces the
+// per-connection and per-client byte limits. A limit of zero disables it,
+// and client IPs are only tracked while there's a per-client limit.
+type quotas struct {
+	maxConnBytes   int64
+	maxClientBytes int64
+
+	terminated int64
+	rejected   int64
+
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+}
+
+// clientUsage is the bytes a client IP has transferred, counted without
+// locking by each of its connections.
+type clientUsage struct {
+	bytes int64
+
+	// conns and idleSince are guarded by quotas.mu.
+	conns     int
+	idleSince time.Time
+}
+
+type quotaResponse struct {
+	MaxConnBytes   int64            `json:"max_conn_bytes"`
+	MaxClientBytes int64            `json:"max_client_bytes"`
+	Terminated     int64            `json:"terminated"`
+	Rejected       int64            `json:"rejected"`
+	Clients        map[string]int64 `json:"clients"`
+}
+
+func newQuotas(maxConnBytes, maxClientBytes int64) *quotas {
+	q := &quotas{
+		maxConnBytes:   maxConnBytes,
+		maxClientBytes: maxClientBytes,
+		clients:        map[string]*clientUsage{},
+	}
+	if maxClientBytes > 0 {
+		go q.expire()
+	}
+
+	return q
+}
+
+// expire forgets client IPs that haven't had a connection open for
+// clientUsageTTL.
+func (q *quotas) expire() {
+	for range time.Tick(time.Minute) {
+		q.mu.Lock()
+		for ip, u := range q.clients {
+			if u.conns == 0 && time.Since(u.idleSince) > clientUsageTTL {
+				delete(q.clients, ip)
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// allow returns false if the client has already used up its byte quota.
+func (q *quotas) allow(ip string) bool {
+	if q.maxClientBytes == 0 {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if u, ok := q.clients[ip]; ok && atomic.LoadInt64(&u.bytes) >= q.maxClientBytes {
+		atomic.AddInt64(&q.rejected, 1)
+		return false
+	}
+	return true
+}
+
+// add records n bytes against the connection and its client, returning
+// false once either quota is exceeded.
+func (m *meter) add(n int64) bool {
+	q := m.quotas
+	if q.maxConnBytes > 0 && atomic.AddInt64(&m.bytes, n) > q.maxConnBytes {
+		return false
+	}
+	if m.client != nil && atomic.AddInt64(&m.client.bytes, n) > q.maxClientBytes {
+		return false
+	}
+	return true
+}
+
+func (q *quotas) snapshot() quotaResponse {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	resp := quotaResponse{
+		MaxConnBytes:   q.maxConnBytes,
+		MaxClientBytes: q.maxClientBytes,
+		Terminated:     atomic.LoadInt64(&q.terminated),
+		Rejected:       atomic.LoadInt64(&q.rejected),
+		Clients:        make(map[string]int64, len(q.clients)),
+	}
+
+	for ip, u := range q.clients {
+		resp.Clients[ip] = atomic.LoadInt64(&u.bytes)
+	}
+
+	return resp
+}
+
+// meter counts the bytes flowing through a single connection in both
+// directions and closes exceeded when a quota is blown. It must be closed
+// when the connection ends.
+type meter struct {
+	quotas   *quotas
+	id       string
+	ip       string
+	bytes    int64
+	client   *clientUsage
+	once     sync.Once
+	exceeded chan struct{}
+}
+
+func (q *quotas) meter(id, ip string) *meter {
+	m := &meter{
+		quotas:   q,
+		id:       id,
+		ip:       ip,
+		exceeded: make(chan struct{}),
+	}
+
+	if q.maxClientBytes > 0 {
+		q.mu.Lock()
+		u, ok := q.clients[ip]
+		if !ok {
+			u = &clientUsage{}
+			q.clients[ip] = u
+		}
+		u.conns++
+		q.mu.Unlock()
+
+		m.client = u
+	}
+
+	return m
+}
+
+// close stops counting the connection against its client, starting the
+// client's expiry if it was its last connection.
+func (m *meter) close() {
+	if m.client == nil {
+		return
+	}
+
+	q := m.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if m.client.conns--; m.client.conns == 0 {
+		m.client.idleSince = time.Now()
+	}
+}
+
+func (m *meter) writer(w io.Writer) io.Writer {
+	return &meteredWriter{w: w, m: m}
+}
+
+type meteredWriter struct {
+	w io.Writer
+	m *meter
+}
+
+func (mw *meteredWriter) Write(p []byte) (int, error) {
+	n, err := mw.w.Write(p)
+	if !mw.m.add(int64(n)) {
+		mw.m.once.Do(func() {
+			atomic.AddInt64(&mw.m.quotas.terminated, 1)
+			log.Printf("[%s] terminating connection from %s: %v", mw.m.id, mw.m.ip, errQuotaExceeded)
+			close(mw.m.exceeded)
+		})
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+func clientIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (svr *server) handleGetQuotas(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetQuotas")
+	defer log.Println("[END] handleGetQuotas")
+
+	return errhandler.SendJSON(w, svr.quotas.snapshot())
+}
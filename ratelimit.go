@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const limiterIdleTimeout = time.Minute * 3
+
+// clientLimiter rate limits control API requests per client IP and caps the
+// size of request bodies.
+type clientLimiter struct {
+	rate    rate.Limit
+	burst   int
+	maxBody int64
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiter(rps float64, maxBody int64) *clientLimiter {
+	l := &clientLimiter{
+		rate:     rate.Limit(rps),
+		burst:    max(1, int(rps*2)),
+		maxBody:  maxBody,
+		limiters: map[string]*limiterEntry{},
+	}
+
+	go l.cleanup()
+	return l
+}
+
+func (l *clientLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.rate > 0 && !l.allow(requestIP(r)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		if l.maxBody > 0 {
+			if r.ContentLength > l.maxBody {
+				http.Error(w, fmt.Sprintf("request body exceeds %d bytes", l.maxBody), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, l.maxBody)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *clientLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.limiters[ip]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.limiters[ip] = e
+	}
+	e.lastSeen = time.Now()
+
+	return e.limiter.Allow()
+}
+
+// cleanup forgets clients that haven't made a request in a while, so the
+// limiter map doesn't grow forever.
+func (l *clientLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for ip, e := range l.limiters {
+			if time.Since(e.lastSeen) > limiterIdleTimeout {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
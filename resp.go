@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const protocolRESP = "resp"
+
+// respWatcher counts the commands a client sends and the replies it gets, so a
+// terminated connection can be closed at a command boundary rather than
+// while a reply is in flight. Pub/sub messages aren't told apart from
+// replies, so subscribed connections look idle.
+type respWatcher struct {
+	retryError bool
+
+	mu       sync.Mutex
+	commands respParser
+	replies  respParser
+	draining bool
+}
+
+func newRESPWatcher(retryError bool) *respWatcher {
+	return &respWatcher{retryError: retryError}
+}
+
+func (rw *respWatcher) toServer(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		rw.mu.Lock()
+		draining := rw.draining
+		if !draining {
+			rw.commands.feed(p)
+		}
+		rw.mu.Unlock()
+
+		// Stop forwarding commands once draining, so the connection can
+		// reach a boundary. The client gets the retry error (or a closed
+		// connection) instead of a reply.
+		if draining {
+			return 0, errDraining
+		}
+
+		return w.Write(p)
+	})
+}
+
+func (rw *respWatcher) toClient(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		n, err := w.Write(p)
+
+		rw.mu.Lock()
+		rw.replies.feed(p[:n])
+		rw.mu.Unlock()
+
+		return n, err
+	})
+}
+
+func (rw *respWatcher) idle() bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	return rw.replies.values >= rw.commands.values
+}
+
+// shutdown waits for outstanding replies before closing the server side and,
+// if enabled, sending the client a TRYAGAIN error that clients treat as
+// transient.
+func (rw *respWatcher) shutdown(client, server net.Conn, serverDone <-chan struct{}) {
+	rw.mu.Lock()
+	rw.draining = true
+	rw.mu.Unlock()
+
+	if !waitIdle(rw.idle, serverDone) {
+		return
+	}
+
+	server.Close()
+	<-serverDone
+
+	if rw.retryError && rw.idle() {
+		client.SetWriteDeadline(time.Now().Add(time.Second))
+		client.Write([]byte("-TRYAGAIN server is being switched, retry the command\r\n"))
+	}
+}
+
+// respParser counts complete top-level RESP values in a stream, without
+// buffering bulk payloads. Inline commands count as a value per line.
+type respParser struct {
+	values int64
+
+	line    []byte
+	skip    int
+	pending []int
+}
+
+func (rp *respParser) feed(p []byte) {
+	for len(p) > 0 {
+		if rp.skip > 0 {
+			n := min(rp.skip, len(p))
+			rp.skip -= n
+			p = p[n:]
+			if rp.skip == 0 {
+				rp.complete()
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			rp.line = append(rp.line, p...)
+			return
+		}
+
+		rp.line = append(rp.line, p[:i+1]...)
+		p = p[i+1:]
+
+		rp.parseLine(bytes.TrimRight(rp.line, "\r\n"))
+		rp.line = rp.line[:0]
+	}
+}
+
+func (rp *respParser) parseLine(line []byte) {
+	if len(line) == 0 {
+		return
+	}
+
+	switch line[0] {
+	case '$', '!', '=':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if n < 0 {
+			rp.complete()
+			return
+		}
+		rp.skip = n + 2
+	case '*', '~', '>', '%':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if line[0] == '%' {
+			n *= 2
+		}
+		if n <= 0 {
+			rp.complete()
+			return
+		}
+		rp.pending = append(rp.pending, n)
+	default:
+		// Simple types, or an inline command.
+		rp.complete()
+	}
+}
+
+// complete records a finished value, finishing any arrays it completes.
+func (rp *respParser) complete() {
+	for len(rp.pending) > 0 {
+		top := len(rp.pending) - 1
+		rp.pending[top]--
+		if rp.pending[top] > 0 {
+			return
+		}
+		rp.pending = rp.pending[:top]
+	}
+
+	rp.values++
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
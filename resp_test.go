@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestRESPParserValues(t *testing.T) {
+	cases := []struct {
+		name   string
+		stream string
+		values int64
+	}{
+		{name: "simple string", stream: "+OK\r\n", values: 1},
+		{name: "error", stream: "-ERR unknown command\r\n", values: 1},
+		{name: "integer", stream: ":42\r\n", values: 1},
+		{name: "bulk string", stream: "$5\r\nhello\r\n", values: 1},
+		{name: "bulk string containing CRLF", stream: "$7\r\nhel\r\nlo\r\n", values: 1},
+		{name: "empty bulk string", stream: "$0\r\n\r\n", values: 1},
+		{name: "null bulk string", stream: "$-1\r\n", values: 1},
+		{name: "null array", stream: "*-1\r\n", values: 1},
+		{name: "empty array", stream: "*0\r\n", values: 1},
+		{name: "command", stream: "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nvalue\r\n", values: 1},
+		{name: "nested arrays", stream: "*2\r\n*2\r\n:1\r\n$1\r\na\r\n*1\r\n*1\r\n+deep\r\n", values: 1},
+		{name: "nulls in an array", stream: "*3\r\n$-1\r\n*-1\r\n:1\r\n", values: 1},
+		{name: "map", stream: "%2\r\n+a\r\n:1\r\n+b\r\n*1\r\n:2\r\n", values: 1},
+		{name: "inline commands", stream: "PING\r\nPING\n", values: 2},
+		{name: "pipelined replies", stream: "+OK\r\n$3\r\nbar\r\n*2\r\n:1\r\n:2\r\n$-1\r\n", values: 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Every way of splitting the stream into two reads should count
+			// the same values, as should a byte at a time.
+			for split := 0; split <= len(c.stream); split++ {
+				var rp respParser
+				rp.feed([]byte(c.stream[:split]))
+				rp.feed([]byte(c.stream[split:]))
+
+				if rp.values != c.values {
+					t.Fatalf("split at %d: got %d values, expected %d", split, rp.values, c.values)
+				}
+			}
+
+			var rp respParser
+			for i := 0; i < len(c.stream); i++ {
+				rp.feed([]byte{c.stream[i]})
+			}
+			if rp.values != c.values {
+				t.Fatalf("byte at a time: got %d values, expected %d", rp.values, c.values)
+			}
+		})
+	}
+}
+
+func TestRESPParserIncomplete(t *testing.T) {
+	cases := []struct {
+		name   string
+		stream string
+	}{
+		{name: "partial line", stream: "+O"},
+		{name: "bulk length only", stream: "$5\r\n"},
+		{name: "bulk payload without CRLF", stream: "$5\r\nhello"},
+		{name: "array missing elements", stream: "*2\r\n:1\r\n"},
+		{name: "nested array missing elements", stream: "*2\r\n*2\r\n:1\r\n:2\r\n"},
+		{name: "array missing a bulk payload", stream: "*1\r\n$3\r\nba"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var rp respParser
+			rp.feed([]byte(c.stream))
+
+			if rp.values != 0 {
+				t.Fatalf("got %d values from an incomplete stream", rp.values)
+			}
+		})
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/codingconcepts/errhandler"
+	"github.com/samber/lo"
+)
+
+// rule sends connections matching an expression to a group, whichever
+// groups are active. Expressions compare the connection's fields, such as
+//
+//	ip in ["10.0.0.0/8", "192.168.0.0/16"] && protocol == "pgwire"
+//	sni matches "\\.eu\\.example\\.com$" || weekday in ["sat", "sun"]
+//	alpn == "postgresql"
+//	hour >= 9 && hour < 17
+type rule struct {
+	When  string `json:"when"`
+	Group string `json:"group"`
+
+	match  ruleExpr
+	fields map[string]bool
+}
+
+// ruleInput is what a connection's matched against.
+type ruleInput struct {
+	ip       net.IP
+	sni      string
+	alpn     string
+	protocol string
+	tag      string
+	now      time.Time
+}
+
+type ruleExpr func(in ruleInput) bool
+
+type ruleFieldKind int
+
+const (
+	ruleString ruleFieldKind = iota
+	ruleNumber
+	ruleIP
+)
+
+type ruleField struct {
+	kind ruleFieldKind
+	str  func(in ruleInput) string
+	num  func(in ruleInput) int
+}
+
+var ruleFields = map[string]ruleField{
+	"ip":       {kind: ruleIP},
+	"sni":      {kind: ruleString, str: func(in ruleInput) string { return in.sni }},
+	"alpn":     {kind: ruleString, str: func(in ruleInput) string { return in.alpn }},
+	"protocol": {kind: ruleString, str: func(in ruleInput) string { return in.protocol }},
+	"tag":      {kind: ruleString, str: func(in ruleInput) string { return in.tag }},
+	"weekday":  {kind: ruleString, str: func(in ruleInput) string { return strings.ToLower(in.now.Weekday().String()[:3]) }},
+	"hour":     {kind: ruleNumber, num: func(in ruleInput) int { return in.now.Hour() }},
+	"minute":   {kind: ruleNumber, num: func(in ruleInput) int { return in.now.Minute() }},
+}
+
+func (r *rule) validate() error {
+	if r.Group == "" {
+		return errors.New("missing rule group")
+	}
+
+	p, err := newRuleParser(r.When)
+	if err != nil {
+		return err
+	}
+	if r.match, err = p.parse(); err != nil {
+		return err
+	}
+	r.fields = p.fields
+
+	return nil
+}
+
+// ruleFor returns the group of the first rule matching a client, peeking at
+// the start of its stream if any rule needs its ClientHello or protocol.
+func (svr *server) ruleFor(client net.Conn, clientIP, tag string) (net.Conn, string) {
+	svr.serversMu.RLock()
+	rules := svr.rules
+	svr.serversMu.RUnlock()
+
+	if len(rules) == 0 {
+		return client, ""
+	}
+
+	in := ruleInput{ip: net.ParseIP(clientIP), tag: tag, now: time.Now()}
+	if lo.SomeBy(rules, func(r rule) bool { return r.fields["sni"] || r.fields["alpn"] }) {
+		var hello clientHello
+		client, hello = peekClientHello(client, svr.peekLimits)
+
+		// Clients list the protocols they offer most preferred first, which
+		// is the one the backend's most likely to pick.
+		in.sni = hello.serverName
+		in.alpn = lo.FirstOr(hello.protocols, "")
+	}
+	if lo.SomeBy(rules, func(r rule) bool { return r.fields["protocol"] }) {
+		client, in.protocol = peekProtocol(client, svr.peekLimits)
+	}
+
+	for _, r := range rules {
+		if r.match(in) {
+			return client, r.Group
+		}
+	}
+	return client, ""
+}
+
+// peekProtocol guesses the protocol a client speaks, without consuming
+// anything it's sent. Clients that wait for the server to speak first are
+// seen as unknown once the peek times out.
+func peekProtocol(client net.Conn, limits peekLimits) (net.Conn, string) {
+	br := bufio.NewReader(client)
+	conn := &bufferedConn{Conn: client, r: br}
+
+	client.SetReadDeadline(time.Now().Add(limits.timeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	first, _ := br.Peek(8)
+	return conn, sniffProtocol(first)
+}
+
+func (svr *server) handleGetRules(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetRules")
+	defer log.Println("[END] handleGetRules")
+
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	return errhandler.SendJSON(w, append([]rule{}, svr.rules...))
+}
+
+// handleSetRules replaces every rule. Rules are checked in order, so the
+// first to match a connection wins.
+func (svr *server) handleSetRules(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSetRules")
+	defer log.Println("[END] handleSetRules")
+
+	var req []rule
+	if err := errhandler.ParseJSON(r, &req); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	for i := range req {
+		if err := req[i].validate(); err != nil {
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("rule %d: %w", i, err))
+		}
+	}
+
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	for i, rule := range req {
+		if _, ok := svr.serverGroups[rule.Group]; !ok {
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("rule %d: group %q not found", i, rule.Group))
+		}
+	}
+
+	log.Printf("[SET] rules: %v", lo.Map(req, func(r rule, _ int) string { return fmt.Sprintf("%q -> %s", r.When, r.Group) }))
+
+	svr.rules = req
+	return nil
+}
+
+type ruleTokenKind int
+
+const (
+	ruleTokenEOF ruleTokenKind = iota
+	ruleTokenIdent
+	ruleTokenString
+	ruleTokenNumber
+	ruleTokenOp
+)
+
+type ruleToken struct {
+	kind ruleTokenKind
+	text string
+	pos  int
+}
+
+var ruleOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+// ruleParser compiles a rule expression. Expressions are comparisons of a
+// field with a value, combined with &&, || and !, and grouped with
+// parentheses.
+type ruleParser struct {
+	tokens []ruleToken
+	next   int
+	fields map[string]bool
+}
+
+func newRuleParser(expr string) (*ruleParser, error) {
+	p := &ruleParser{fields: map[string]bool{}}
+
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(expr) && (expr[i] == '_' || unicode.IsLetter(rune(expr[i])) || unicode.IsDigit(rune(expr[i]))) {
+				i++
+			}
+			p.tokens = append(p.tokens, ruleToken{kind: ruleTokenIdent, text: expr[start:i], pos: start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(expr) && unicode.IsDigit(rune(expr[i])) {
+				i++
+			}
+			p.tokens = append(p.tokens, ruleToken{kind: ruleTokenNumber, text: expr[start:i], pos: start})
+		case c == '"':
+			quoted, err := strconv.QuotedPrefix(expr[i:])
+			if err != nil {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s, _ := strconv.Unquote(quoted)
+			p.tokens = append(p.tokens, ruleToken{kind: ruleTokenString, text: s, pos: i})
+			i += len(quoted)
+		default:
+			op, ok := lo.Find(ruleOps, func(op string) bool { return strings.HasPrefix(expr[i:], op) })
+			if !ok {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			p.tokens = append(p.tokens, ruleToken{kind: ruleTokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	p.tokens = append(p.tokens, ruleToken{kind: ruleTokenEOF, pos: len(expr)})
+
+	return p, nil
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.next]
+}
+
+func (p *ruleParser) take() ruleToken {
+	t := p.tokens[p.next]
+	if t.kind != ruleTokenEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *ruleParser) takeOp(op string) bool {
+	if t := p.peek(); t.kind == ruleTokenOp && t.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (t ruleToken) String() string {
+	switch t.kind {
+	case ruleTokenEOF:
+		return "end of rule"
+	case ruleTokenString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q at %d", t.text, t.pos)
+	}
+}
+
+func (p *ruleParser) parse() (ruleExpr, error) {
+	if p.peek().kind == ruleTokenEOF {
+		return nil, errors.New("missing rule expression")
+	}
+
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != ruleTokenEOF {
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+	return expr, nil
+}
+
+func (p *ruleParser) or() (ruleExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.takeOp("||") {
+		a := left
+		b, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = func(in ruleInput) bool { return a(in) || b(in) }
+	}
+	return left, nil
+}
+
+func (p *ruleParser) and() (ruleExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.takeOp("&&") {
+		a := left
+		b, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = func(in ruleInput) bool { return a(in) && b(in) }
+	}
+	return left, nil
+}
+
+func (p *ruleParser) unary() (ruleExpr, error) {
+	if p.takeOp("!") {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(in ruleInput) bool { return !e(in) }, nil
+	}
+
+	if p.takeOp("(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.takeOp(")") {
+			return nil, fmt.Errorf("expected \")\", got %s", p.peek())
+		}
+		return e, nil
+	}
+
+	return p.comparison()
+}
+
+// comparison parses a field, an operator (==, !=, <, <=, >, >=, in or
+// matches) and a value (a string, a number or a list of them).
+func (p *ruleParser) comparison() (ruleExpr, error) {
+	t := p.take()
+	field, ok := ruleFields[t.text]
+	if t.kind != ruleTokenIdent || !ok {
+		names := lo.Keys(ruleFields)
+		sort.Strings(names)
+		return nil, fmt.Errorf("expected a field (one of %s), got %s", strings.Join(names, ", "), t)
+	}
+	p.fields[t.text] = true
+
+	op := p.take()
+	if op.kind != ruleTokenOp && op.kind != ruleTokenIdent {
+		return nil, fmt.Errorf("expected an operator after %s, got %s", t.text, op)
+	}
+
+	values, err := p.values(op.text == "in")
+	if err != nil {
+		return nil, err
+	}
+
+	switch field.kind {
+	case ruleString:
+		return stringComparison(field.str, op, values)
+	case ruleNumber:
+		return numberComparison(field.num, op, values)
+	default:
+		return ipComparison(op, values)
+	}
+}
+
+// values parses a single value, or a list of them if list is set.
+func (p *ruleParser) values(list bool) ([]ruleToken, error) {
+	value := func() (ruleToken, error) {
+		t := p.take()
+		if t.kind != ruleTokenString && t.kind != ruleTokenNumber {
+			return t, fmt.Errorf("expected a string or a number, got %s", t)
+		}
+		return t, nil
+	}
+
+	if !list || !p.takeOp("[") {
+		v, err := value()
+		return []ruleToken{v}, err
+	}
+
+	var values []ruleToken
+	for !p.takeOp("]") {
+		if len(values) > 0 && !p.takeOp(",") {
+			return nil, fmt.Errorf("expected \",\" or \"]\", got %s", p.peek())
+		}
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func stringComparison(get func(ruleInput) string, op ruleToken, values []ruleToken) (ruleExpr, error) {
+	for _, v := range values {
+		if v.kind != ruleTokenString {
+			return nil, fmt.Errorf("expected a string, got %s", v)
+		}
+	}
+	want := lo.Map(values, func(v ruleToken, _ int) string { return v.text })
+
+	switch op.text {
+	case "==":
+		return func(in ruleInput) bool { return get(in) == want[0] }, nil
+	case "!=":
+		return func(in ruleInput) bool { return get(in) != want[0] }, nil
+	case "in":
+		return func(in ruleInput) bool { return slices.Contains(want, get(in)) }, nil
+	case "matches":
+		re, err := regexp.Compile(want[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", want[0], err)
+		}
+		return func(in ruleInput) bool { return re.MatchString(get(in)) }, nil
+	default:
+		return nil, fmt.Errorf("can't compare strings with %s", op)
+	}
+}
+
+func numberComparison(get func(ruleInput) int, op ruleToken, values []ruleToken) (ruleExpr, error) {
+	var want []int
+	for _, v := range values {
+		n, err := strconv.Atoi(v.text)
+		if v.kind != ruleTokenNumber || err != nil {
+			return nil, fmt.Errorf("expected a number, got %s", v)
+		}
+		want = append(want, n)
+	}
+
+	compare := map[string]func(a, b int) bool{
+		"==": func(a, b int) bool { return a == b },
+		"!=": func(a, b int) bool { return a != b },
+		"<":  func(a, b int) bool { return a < b },
+		"<=": func(a, b int) bool { return a <= b },
+		">":  func(a, b int) bool { return a > b },
+		">=": func(a, b int) bool { return a >= b },
+	}
+
+	if op.text == "in" {
+		return func(in ruleInput) bool { return slices.Contains(want, get(in)) }, nil
+	}
+	if fn, ok := compare[op.text]; ok {
+		return func(in ruleInput) bool { return fn(get(in), want[0]) }, nil
+	}
+	return nil, fmt.Errorf("can't compare numbers with %s", op)
+}
+
+// ipComparison compares the client's IP with an address, or checks it's in
+// one of a list of networks (or addresses).
+func ipComparison(op ruleToken, values []ruleToken) (ruleExpr, error) {
+	var networks []*net.IPNet
+	for _, v := range values {
+		if v.kind != ruleTokenString {
+			return nil, fmt.Errorf("expected an address or network, got %s", v)
+		}
+		if op.text != "in" && strings.Contains(v.text, "/") {
+			return nil, fmt.Errorf("can't compare ip with a network using %s, use in", op)
+		}
+
+		network, err := parseNetwork(v.text)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	contains := func(in ruleInput) bool {
+		return in.ip != nil && lo.SomeBy(networks, func(n *net.IPNet) bool { return n.Contains(in.ip) })
+	}
+
+	switch op.text {
+	case "==", "in":
+		return contains, nil
+	case "!=":
+		return func(in ruleInput) bool { return !contains(in) }, nil
+	default:
+		return nil, fmt.Errorf("can't compare ip with %s", op)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleMatches(t *testing.T) {
+	// A Saturday.
+	saturday := time.Date(2026, 10, 17, 10, 30, 0, 0, time.Local)
+
+	in := ruleInput{
+		ip:       net.ParseIP("10.1.2.3"),
+		sni:      "db.eu.example.com",
+		alpn:     "postgresql",
+		protocol: "pgwire",
+		tag:      "presenter",
+		now:      saturday,
+	}
+
+	cases := []struct {
+		name string
+		when string
+		want bool
+	}{
+		{"string equals", `tag == "presenter"`, true},
+		{"string not equals", `tag != "presenter"`, false},
+		{"string in list", `protocol in ["tls", "pgwire"]`, true},
+		{"string not in list", `protocol in ["tls", "http"]`, false},
+		{"empty list", `protocol in []`, false},
+		{"matches", `sni matches "\\.eu\\.example\\.com$"`, true},
+		{"doesn't match", `sni matches "^eu\\."`, false},
+		{"alpn", `alpn == "postgresql"`, true},
+		{"alpn in list", `alpn in ["h2", "http/1.1"]`, false},
+		{"escaped quote", `tag == "pre\"senter"`, false},
+		{"unicode escape", `tag == "pre\u0073enter"`, true},
+
+		{"ip in cidr", `ip in "10.0.0.0/8"`, true},
+		{"ip not in cidr", `ip in "192.168.0.0/16"`, false},
+		{"ip in cidr list", `ip in ["192.168.0.0/16", "10.1.0.0/16"]`, true},
+		{"ip in address list", `ip in ["10.1.2.3"]`, true},
+		{"ip equals", `ip == "10.1.2.3"`, true},
+		{"ip not equals", `ip != "10.1.2.3"`, false},
+		{"ipv6 cidr", `ip in "::/0"`, false},
+
+		{"hour window", `hour >= 9 && hour < 17`, true},
+		{"outside hour window", `hour < 9 || hour >= 17`, false},
+		{"minute", `minute == 30`, true},
+		{"hour in list", `hour in [9, 10, 11]`, true},
+		{"weekend", `weekday in ["sat", "sun"]`, true},
+		{"weekday", `weekday == "mon"`, false},
+
+		{"and binds tighter than or", `tag == "x" && tag == "y" || protocol == "pgwire"`, true},
+		{"and binds tighter than or on the right", `protocol == "pgwire" || tag == "x" && tag == "y"`, true},
+		{"parentheses override precedence", `(protocol == "pgwire" || tag == "x") && tag == "y"`, false},
+		{"not", `!(tag == "x")`, true},
+		{"not binds tighter than and", `!tag == "x" && protocol == "tls"`, false},
+		{"double not", `!!(tag == "presenter")`, true},
+		{"not of or", `!(tag == "x" || protocol == "pgwire")`, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := rule{When: c.when, Group: "g"}
+			if err := r.validate(); err != nil {
+				t.Fatalf("validating %q: %v", c.when, err)
+			}
+			if got := r.match(in); got != c.want {
+				t.Fatalf("%q: got %v, want %v", c.when, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatchesMissingIP(t *testing.T) {
+	r := rule{When: `ip in "0.0.0.0/0"`, Group: "g"}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if r.match(ruleInput{}) {
+		t.Fatal("matched a client without an IP")
+	}
+}
+
+func TestRuleFields(t *testing.T) {
+	r := rule{When: `sni == "a" || (tag == "b" && hour > 1)`, Group: "g"}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"sni", "tag", "hour"} {
+		if !r.fields[f] {
+			t.Errorf("%s not recorded as a field the rule uses", f)
+		}
+	}
+	if r.fields["protocol"] {
+		t.Error("protocol recorded as a field the rule uses")
+	}
+}
+
+func TestRuleParseErrors(t *testing.T) {
+	cases := []struct {
+		when string
+		want string
+	}{
+		{``, "missing rule expression"},
+		{`   `, "missing rule expression"},
+		{`colour == "red"`, `expected a field`},
+		{`tag`, `expected an operator after tag`},
+		{`tag ==`, `expected a string or a number, got end of rule`},
+		{`tag == "a`, `unterminated string at 7`},
+		{`tag == 'a'`, `unexpected '\'' at 7`},
+		{`tag == 1`, `expected a string`},
+		{`tag < "a"`, `can't compare strings with "<"`},
+		{`hour == "9"`, `expected a number`},
+		{`hour matches 9`, `can't compare numbers with "matches"`},
+		{`ip == "10.0.0.0/8"`, `use in`},
+		{`ip in "10.0.0.0/33"`, `invalid CIDR address`},
+		{`ip in [1]`, `expected an address or network`},
+		{`ip < "10.0.0.1"`, `can't compare ip with "<"`},
+		{`sni matches "("`, `invalid pattern`},
+		{`(tag == "a"`, `expected ")", got end of rule`},
+		{`tag == "a")`, `unexpected ")" at 10`},
+		{`tag == "a" &&`, `expected a field`},
+		{`tag == "a" tag == "b"`, `unexpected "tag" at 11`},
+		{`tag in ["a" "b"]`, `expected "," or "]"`},
+		{`tag in ["a",`, `expected a string or a number, got end of rule`},
+		{`tag == "a" & tag == "b"`, `unexpected '&' at 11`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.when, func(t *testing.T) {
+			r := rule{When: c.when, Group: "g"}
+			err := r.validate()
+			if err == nil {
+				t.Fatalf("%q: expected an error", c.when)
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("%q: got %q, want it to contain %q", c.when, err, c.want)
+			}
+		})
+	}
+}
+
+func TestSetRulesUnknownGroup(t *testing.T) {
+	cfg := defaultServerConfig()
+	cfg.ctlRate = 0
+	svr := newServer(cfg)
+
+	if err := svr.setGroup(setGroupRequest{Name: "known", Servers: []string{"localhost:26001"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctl := httptest.NewServer(svr.httpServer().Handler)
+	defer ctl.Close()
+
+	cases := []struct {
+		body string
+		want int
+	}{
+		{`[{"when": "tag == \"a\"", "group": "known"}]`, http.StatusOK},
+		{`[{"when": "tag == \"a\"", "group": "known"}, {"when": "tag == \"b\"", "group": "unknown"}]`, http.StatusUnprocessableEntity},
+		{`[{"when": "tag ==", "group": "known"}]`, http.StatusUnprocessableEntity},
+		{`[{"when": "tag == \"a\""}]`, http.StatusUnprocessableEntity},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(http.MethodPut, ctl.URL+"/v1/rules", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.want {
+			t.Errorf("%s: got %s, want %d", c.body, resp.Status, c.want)
+		}
+	}
+
+	// The rules that failed to validate didn't replace the ones that did.
+	if len(svr.rules) != 1 || svr.rules[0].Group != "known" {
+		t.Fatalf("unexpected rules: %+v", svr.rules)
+	}
+
+	if err := svr.deleteGroup("known"); err == nil {
+		t.Fatal("deleted a group a rule routes to")
+	}
+}
+
+func TestRuleForClientHello(t *testing.T) {
+	cfg := defaultServerConfig()
+	cfg.peekLimits.timeout = time.Second
+	svr := newServer(cfg)
+
+	svr.rules = []rule{
+		{When: `alpn == "h2"`, Group: "web"},
+		{When: `alpn == "postgresql" && sni == "db.example.com"`, Group: "db"},
+	}
+	for i := range svr.rules {
+		if err := svr.rules[i].validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name      string
+		protocols []string
+		want      string
+	}{
+		{"most preferred protocol", []string{"h2", "http/1.1"}, "web"},
+		{"only protocol", []string{"postgresql"}, "db"},
+		{"less preferred protocol", []string{"http/1.1", "h2"}, ""},
+		{"no protocols", nil, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, clientEnd := net.Pipe()
+			defer client.Close()
+
+			go func() {
+				tls.Client(clientEnd, &tls.Config{ServerName: "db.example.com", NextProtos: c.protocols}).Handshake()
+			}()
+			defer clientEnd.Close()
+
+			conn, group := svr.ruleFor(client, "127.0.0.1", "")
+			if group != c.want {
+				t.Fatalf("got group %q, want %q", group, c.want)
+			}
+
+			// The ClientHello is replayed for the backend.
+			record := make([]byte, 5)
+			if _, err := io.ReadFull(conn, record); err != nil {
+				t.Fatal(err)
+			}
+			if record[0] != 0x16 {
+				t.Fatalf("got record type %#x, want a handshake", record[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+type serverState struct {
+	Server   string    `json:"server"`
+	Groups   []string  `json:"groups"`
+	Cordoned bool      `json:"cordoned"`
+	Ejected  *ejection `json:"ejected,omitempty"`
+}
+
+// servers returns every server that's in a group or cordoned, along with the
+// groups it's in.
+func (svr *server) servers() []serverState {
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	states := map[string]*serverState{}
+	state := func(addr string) *serverState {
+		s, ok := states[addr]
+		if !ok {
+			s = &serverState{
+				Server:   addr,
+				Groups:   []string{},
+				Cordoned: svr.cordonedServers[addr],
+				Ejected:  svr.outliers.ejection(addr),
+			}
+			states[addr] = s
+		}
+		return s
+	}
+
+	for name, g := range svr.serverGroups {
+		for _, addr := range g.Servers {
+			s := state(addr)
+			s.Groups = append(s.Groups, name)
+		}
+	}
+	for addr := range svr.cordonedServers {
+		state(addr)
+	}
+
+	list := make([]serverState, 0, len(states))
+	for _, s := range states {
+		sort.Strings(s.Groups)
+		list = append(list, *s)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Server < list[j].Server
+	})
+
+	return list
+}
+
+// setCordoned sets whether a server is cordoned.
+func (svr *server) setCordoned(addr string, cordoned bool) {
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	if cordoned {
+		svr.cordonedServers[addr] = true
+	} else {
+		delete(svr.cordonedServers, addr)
+	}
+}
+
+func (svr *server) handleGetServers(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetServers")
+	defer log.Println("[END] handleGetServers")
+
+	p, err := parsePage(r)
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	cordoned, err := parseBoolFilter(r, "cordoned")
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	servers := []serverState{}
+	for _, s := range svr.servers() {
+		if p.matches(s.Server) && (cordoned == nil || s.Cordoned == *cordoned) {
+			servers = append(servers, s)
+		}
+	}
+
+	return errhandler.SendJSON(w, paginate(w, p, servers))
+}
+
+func (svr *server) handleCordonServer(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleCordonServer")
+	defer log.Println("[END] handleCordonServer")
+
+	addr := r.PathValue("addr")
+	svr.setCordoned(addr, true)
+
+	log.Printf("cordoned server %q", addr)
+	return nil
+}
+
+func (svr *server) handleUncordonServer(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleUncordonServer")
+	defer log.Println("[END] handleUncordonServer")
+
+	addr := r.PathValue("addr")
+	svr.setCordoned(addr, false)
+
+	log.Printf("uncordoned server %q", addr)
+	return nil
+}
+
+// handleDrainServer cordons a server and optionally terminates its existing
+// connections.
+func (svr *server) handleDrainServer(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleDrainServer")
+	defer log.Println("[END] handleDrainServer")
+
+	addr := r.PathValue("addr")
+
+	terminate := false
+	if v := r.URL.Query().Get("terminate"); v != "" {
+		var err error
+		if terminate, err = strconv.ParseBool(v); err != nil {
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("parsing terminate: %w", err))
+		}
+	}
+
+	svr.setCordoned(addr, true)
+
+	log.Printf("drained server %q", addr)
+	svr.events.publish(event{Kind: eventDrain, Servers: []string{addr}})
+
+	if terminate {
+		svr.events.publish(event{Kind: eventTerminate, Servers: []string{addr}})
+	}
+
+	return nil
+}
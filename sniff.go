@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+const (
+	sniffedPgwire  = "pgwire"
+	sniffedTLS     = "tls"
+	sniffedHTTP    = "http"
+	sniffedUnknown = "unknown"
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("PRI * HTTP/2"),
+}
+
+// sniffProtocol guesses the protocol a client speaks from the first bytes
+// it sends.
+func sniffProtocol(p []byte) string {
+	if len(p) >= 3 && p[0] == 0x16 && p[1] == 0x03 {
+		return sniffedTLS
+	}
+
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(p, m) {
+			return sniffedHTTP
+		}
+	}
+
+	if len(p) >= 8 {
+		switch binary.BigEndian.Uint32(p[4:8]) {
+		case pgProtocolVersion3, pgSSLRequestCode, pgGSSENCRequestCode, pgCancelRequestCode:
+			return sniffedPgwire
+		}
+	}
+
+	return sniffedUnknown
+}
+
+// protocolCounts counts the protocols clients are seen to speak, overall and
+// by group, so clients connecting to the wrong port stand out.
+type protocolCounts struct {
+	mu     sync.Mutex
+	total  map[string]int64
+	groups map[string]map[string]int64
+}
+
+type protocolCountsResponse struct {
+	Total  map[string]int64            `json:"total"`
+	Groups map[string]map[string]int64 `json:"groups"`
+}
+
+func newProtocolCounts() *protocolCounts {
+	return &protocolCounts{
+		total:  map[string]int64{},
+		groups: map[string]map[string]int64{},
+	}
+}
+
+func (pc *protocolCounts) record(group, protocol string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.total[protocol]++
+
+	counts, ok := pc.groups[group]
+	if !ok {
+		counts = map[string]int64{}
+		pc.groups[group] = counts
+	}
+	counts[protocol]++
+}
+
+// writer sniffs the first write of a client's stream.
+func (pc *protocolCounts) writer(group string, w io.Writer) io.Writer {
+	return &sniffWriter{counts: pc, group: group, w: w}
+}
+
+type sniffWriter struct {
+	counts  *protocolCounts
+	group   string
+	w       io.Writer
+	sniffed bool
+}
+
+func (sw *sniffWriter) Write(p []byte) (int, error) {
+	if !sw.sniffed && len(p) > 0 {
+		sw.sniffed = true
+		sw.counts.record(sw.group, sniffProtocol(p))
+	}
+	return sw.w.Write(p)
+}
+
+func (svr *server) handleGetProtocols(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetProtocols")
+	defer log.Println("[END] handleGetProtocols")
+
+	pc := svr.protocols
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return errhandler.SendJSON(w, protocolCountsResponse{Total: pc.total, Groups: pc.groups})
+}
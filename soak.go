@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// soak runs an in-process proxy against built-in echo backends, cycling
+// activations under load, to check the data path doesn't leak goroutines or
+// file descriptors.
+type soak struct {
+	svr   *server
+	addr  string
+	size  int
+	debug bool
+
+	verified    int64
+	interrupted int64
+	corrupted   int64
+}
+
+type soakSample struct {
+	goroutines int
+	fds        int
+}
+
+func runSoak(args []string) {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	duration := fs.Duration("duration", time.Hour, "how long to soak for")
+	interval := fs.Duration("interval", time.Second*5, "how often to switch the active group")
+	rate := fs.Int("rate", 50, "number of connections to open per second")
+	size := fs.Int("size", 1024, "bytes to echo on each connection")
+	maxGoroutines := fs.Int("max-goroutine-growth", 50, "goroutine growth allowed between the start and end of the soak")
+	maxFDs := fs.Int("max-fd-growth", 20, "file descriptor growth allowed between the start and end of the soak")
+	fs.Parse(args)
+
+	if *rate <= 0 {
+		log.Fatalf("rate must be greater than zero")
+	}
+
+	s, err := newSoak(*size)
+	if err != nil {
+		log.Fatalf("error starting soak: %v", err)
+	}
+
+	before := s.sample()
+	log.Printf("soaking %s for %s at %d connections/s, switching groups every %s", s.addr, *duration, *rate, *interval)
+
+	peak := s.run(*duration, *interval, *rate)
+	after := s.settle(before)
+
+	checks := []check{
+		{name: "no corrupted echoes", err: soakCount(s.corrupted, "corrupted echoes")},
+		{name: "no recovered panics", err: soakCount(s.svr.panics.connections.Load(), "recovered panics")},
+		{name: fmt.Sprintf("goroutine growth is at most %d", *maxGoroutines), err: soakGrowth("goroutines", before.goroutines, after.goroutines, *maxGoroutines)},
+	}
+	if before.fds >= 0 {
+		checks = append(checks, check{
+			name: fmt.Sprintf("file descriptor growth is at most %d", *maxFDs),
+			err:  soakGrowth("file descriptors", before.fds, after.fds, *maxFDs),
+		})
+	}
+
+	log.Printf("verified: %d interrupted: %d corrupted: %d", s.verified, s.interrupted, s.corrupted)
+	log.Printf("goroutines: %d -> %d (peak %d) file descriptors: %d -> %d (peak %d)",
+		before.goroutines, after.goroutines, peak.goroutines, before.fds, after.fds, peak.fds)
+
+	var failed int
+	for _, c := range checks {
+		if c.err != nil {
+			failed++
+			log.Printf("[FAIL] %s: %v", c.name, c.err)
+			continue
+		}
+		log.Printf("[OK]   %s", c.name)
+	}
+
+	if failed > 0 {
+		log.Printf("soak failed %d of %d checks", failed, len(checks))
+		os.Exit(1)
+	}
+	log.Printf("soak passed all %d checks", len(checks))
+}
+
+func newSoak(size int) (*soak, error) {
+	// The soak exercises the same server dp runs, with its default settings.
+	svr := newServer(defaultServerConfig())
+
+	for _, name := range []string{"blue", "green"} {
+		addr, err := startEcho()
+		if err != nil {
+			return nil, fmt.Errorf("starting %s echo backend: %w", name, err)
+		}
+		if err = svr.setGroup(setGroupRequest{Name: name, Servers: []string{addr}}); err != nil {
+			return nil, fmt.Errorf("creating %s group: %w", name, err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("binding proxy port: %w", err)
+	}
+
+	go svr.serveProxy(listener)
+
+	return &soak{svr: svr, addr: listener.Addr().String(), size: size}, nil
+}
+
+// run generates load while switching the active group, returning the peak
+// goroutine and file descriptor counts seen.
+func (s *soak) run(duration, interval time.Duration, rate int) soakSample {
+	connect := time.NewTicker(time.Second / time.Duration(rate))
+	defer connect.Stop()
+
+	activate := time.NewTicker(interval)
+	defer activate.Stop()
+
+	sample := time.NewTicker(time.Second)
+	defer sample.Stop()
+
+	deadline := time.After(duration)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	groups := []string{"blue", "green"}
+	s.svr.setActiveGroups(groups[:1])
+
+	var peak soakSample
+	for i := 1; ; {
+		select {
+		case <-deadline:
+			return peak
+		case <-connect.C:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.echo()
+			}()
+		case <-activate.C:
+			s.svr.setActiveGroups(groups[i%2 : i%2+1])
+			s.svr.terminate()
+			i++
+		case <-sample.C:
+			current := s.sample()
+			peak.goroutines = max(peak.goroutines, current.goroutines)
+			peak.fds = max(peak.fds, current.fds)
+		}
+	}
+}
+
+// echo sends random bytes through the proxy and checks they come back
+// unchanged. Connections cut short by a termination are expected.
+func (s *soak) echo() {
+	conn, err := net.DialTimeout("tcp", s.addr, time.Second*5)
+	if err != nil {
+		atomic.AddInt64(&s.interrupted, 1)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	sent := make([]byte, s.size)
+	rand.Read(sent)
+
+	if _, err = conn.Write(sent); err != nil {
+		atomic.AddInt64(&s.interrupted, 1)
+		return
+	}
+
+	received := make([]byte, s.size)
+	n, err := io.ReadFull(conn, received)
+	if !bytes.Equal(sent[:n], received[:n]) {
+		atomic.AddInt64(&s.corrupted, 1)
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&s.interrupted, 1)
+		return
+	}
+
+	atomic.AddInt64(&s.verified, 1)
+}
+
+// settle drains the proxy and waits for its goroutines to wind down to where
+// they started, giving up after 10 seconds.
+func (s *soak) settle(before soakSample) soakSample {
+	s.svr.setActiveGroups(nil)
+	s.svr.terminateNow()
+
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		current := s.sample()
+		if current.goroutines <= before.goroutines || time.Now().After(deadline) {
+			return current
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// sample returns the current number of goroutines and open file descriptors
+// (-1 if they can't be counted on this platform).
+func (s *soak) sample() soakSample {
+	fds := -1
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fds = len(entries)
+	}
+
+	return soakSample{goroutines: runtime.NumGoroutine(), fds: fds}
+}
+
+func soakCount(n int64, what string) error {
+	if n > 0 {
+		return fmt.Errorf("%d %s", n, what)
+	}
+	return nil
+}
+
+func soakGrowth(what string, before, after, allowed int) error {
+	if growth := after - before; growth > allowed {
+		return fmt.Errorf("%s grew by %d (from %d to %d)", what, growth, before, after)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sshKeepaliveInterval = time.Second * 30
+
+// sshTunnels holds the SSH clients used to reach servers behind jump hosts,
+// keyed by the jump host configuration so groups sharing a jump host share
+// a connection.
+var sshTunnels = &tunnelPool{
+	clients: map[egress]*ssh.Client{},
+	dialing: map[egress]*tunnelDial{},
+}
+
+type tunnelPool struct {
+	// dir is the directory ssh egress key and known hosts files are read
+	// from (set by -ssh-dir), so control API callers can't have dp read
+	// any file it can.
+	dir string
+
+	mu      sync.Mutex
+	clients map[egress]*ssh.Client
+	dialing map[egress]*tunnelDial
+}
+
+// tunnelDial is a jump host being dialed, which callers wanting the same
+// tunnel wait on rather than dialing it again.
+type tunnelDial struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+func (e *egress) dialSSH(server string) (net.Conn, error) {
+	client, err := sshTunnels.get(*e)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial("tcp", server)
+	if err == nil {
+		return conn, nil
+	}
+
+	// The tunnel may have died since it was last used, so try once more with
+	// a fresh one before giving up.
+	sshTunnels.drop(*e, client)
+	if client, err = sshTunnels.get(*e); err != nil {
+		return nil, err
+	}
+
+	return client.Dial("tcp", server)
+}
+
+func (p *tunnelPool) get(e egress) (*ssh.Client, error) {
+	p.mu.Lock()
+	if client, ok := p.clients[e]; ok {
+		p.mu.Unlock()
+		return client, nil
+	}
+	if d, ok := p.dialing[e]; ok {
+		p.mu.Unlock()
+		<-d.done
+		return d.client, d.err
+	}
+
+	// Dial without holding the lock, so a slow jump host doesn't hold up
+	// connections through every other tunnel.
+	d := &tunnelDial{done: make(chan struct{})}
+	p.dialing[e] = d
+	p.mu.Unlock()
+
+	d.client, d.err = p.dial(e)
+
+	p.mu.Lock()
+	delete(p.dialing, e)
+	if d.err == nil {
+		p.clients[e] = d.client
+		go p.keepalive(e, d.client)
+	}
+	p.mu.Unlock()
+	close(d.done)
+
+	return d.client, d.err
+}
+
+func (p *tunnelPool) dial(e egress) (*ssh.Client, error) {
+	config, err := e.sshConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ssh.Dial("tcp", e.Addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("dialing ssh jump host: %w", err)
+	}
+	log.Printf("established ssh tunnel to %s", e.Addr)
+
+	return client, nil
+}
+
+// path returns where a key or known hosts file named in an ssh egress is,
+// which must be within the -ssh-dir directory.
+func (p *tunnelPool) path(name string) (string, error) {
+	if p.dir == "" {
+		return "", errors.New("ssh egress files can't be used without -ssh-dir")
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%q must be a path within -ssh-dir", name)
+	}
+
+	return filepath.Join(p.dir, name), nil
+}
+
+func (p *tunnelPool) drop(e egress, client *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.clients[e] == client {
+		delete(p.clients, e)
+	}
+	client.Close()
+}
+
+func (p *tunnelPool) keepalive(e egress, client *ssh.Client) {
+	ticker := time.NewTicker(sshKeepaliveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			log.Printf("ssh tunnel to %s lost: %v", e.Addr, err)
+			p.drop(e, client)
+			return
+		}
+	}
+}
+
+func (e *egress) sshConfig() (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+
+	if e.KeyFile != "" {
+		path, err := sshTunnels.path(e.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading ssh key: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ssh key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if e.Password != "" {
+		auth = append(auth, ssh.Password(e.Password))
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if e.KnownHosts != "" {
+		path, err := sshTunnels.path(e.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+
+		if hostKeyCallback, err = knownhosts.New(path); err != nil {
+			return nil, fmt.Errorf("reading known hosts: %w", err)
+		}
+	} else {
+		log.Printf("ssh jump host %s is insecure, skipping host key verification", e.Addr)
+	}
+
+	return &ssh.ClientConfig{
+		User:            e.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Second * 10,
+	}, nil
+}
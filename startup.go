@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes returned by dp, so wrappers can tell failure classes apart.
+// Flag parsing errors exit with 2, which is what the flag package uses.
+const (
+	exitBadFlags    = 2
+	exitBindFailure = 3
+	exitConfigError = 4
+	exitServeError  = 5
+)
+
+type startupResult struct {
+	Status    string `json:"status"`
+	Class     string `json:"class,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	CtlPort   int    `json:"ctl_port,omitempty"`
+	CtlSocket string `json:"ctl_socket,omitempty"`
+}
+
+type startup struct {
+	json      bool
+	port      int
+	ctlPort   int
+	ctlSocket string
+}
+
+func (s startup) ready() {
+	log.Printf("ready")
+
+	if s.json {
+		result := startupResult{Status: "ready", Port: s.port, CtlPort: s.ctlPort}
+		if s.ctlSocket != "" {
+			result.CtlPort, result.CtlSocket = 0, s.ctlSocket
+		}
+		s.print(result)
+	}
+}
+
+func (s startup) fail(code int, class string, err error) {
+	log.Printf("error starting proxy server: %v", err)
+
+	if s.json {
+		s.print(startupResult{Status: "error", Class: class, Error: err.Error()})
+	}
+
+	os.Exit(code)
+}
+
+func (s startup) print(result startupResult) {
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing startup result: %v\n", err)
+	}
+}
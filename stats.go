@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+var statsResolutions = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": time.Minute * 5,
+	"1h": time.Hour,
+}
+
+// stats keeps time-bucketed rollups of connections and bytes per group at
+// each resolution, dropping (and optionally spilling to a file) buckets
+// older than the retention. Bytes are counted per connection without
+// locking and folded into the rollups every statsFoldInterval, when the
+// stats are queried and when the connection closes.
+type stats struct {
+	retention time.Duration
+	spillPath string
+
+	mu      sync.Mutex
+	rollups map[string]map[time.Time]map[string]*statsBucket
+	live    map[*statsCounter]bool
+}
+
+const statsFoldInterval = time.Second
+
+// statsCounter counts the bytes a connection has transferred since they
+// were last folded into the rollups.
+type statsCounter struct {
+	stats    *stats
+	group    string
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+type statsBucket struct {
+	Connections int64 `json:"connections"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+}
+
+type statsRow struct {
+	Time       time.Time               `json:"time"`
+	Resolution string                  `json:"resolution"`
+	Groups     map[string]*statsBucket `json:"groups"`
+}
+
+func newStats(retention time.Duration, spillPath string) *stats {
+	s := &stats{
+		retention: retention,
+		spillPath: spillPath,
+		rollups:   map[string]map[time.Time]map[string]*statsBucket{},
+		live:      map[*statsCounter]bool{},
+	}
+	for label := range statsResolutions {
+		s.rollups[label] = map[time.Time]map[string]*statsBucket{}
+	}
+
+	go s.prune()
+	go s.foldEvery(statsFoldInterval)
+	return s
+}
+
+// record applies fn to the group's bucket at each resolution. s.mu must be
+// held.
+func (s *stats) record(now time.Time, group string, fn func(b *statsBucket)) {
+	for label, buckets := range s.rollups {
+		t := now.Truncate(statsResolutions[label])
+
+		groups, ok := buckets[t]
+		if !ok {
+			groups = map[string]*statsBucket{}
+			buckets[t] = groups
+		}
+
+		b, ok := groups[group]
+		if !ok {
+			b = &statsBucket{}
+			groups[group] = b
+		}
+
+		fn(b)
+	}
+}
+
+// connection counts a connection against the group, returning the counter
+// for its bytes, which must be closed when the connection ends.
+func (s *stats) connection(group string) *statsCounter {
+	c := &statsCounter{stats: s, group: group}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.record(time.Now(), group, func(b *statsBucket) { b.Connections++ })
+	s.live[c] = false
+	return c
+}
+
+// close folds the connection's bytes into the rollups, leaving it to be
+// folded once more (for anything its copies were still writing at the
+// time) before it's forgotten.
+func (c *statsCounter) close() {
+	s := c.stats
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fold(time.Now(), c)
+	s.live[c] = true
+}
+
+// writer counts bytes written to w, as bytes in if they're headed to the
+// server and bytes out if they're headed to the client.
+func (c *statsCounter) writer(toServer bool, w io.Writer) io.Writer {
+	n := &c.bytesOut
+	if toServer {
+		n = &c.bytesIn
+	}
+	return &statsWriter{n: n, w: w}
+}
+
+type statsWriter struct {
+	n *atomic.Int64
+	w io.Writer
+}
+
+func (sw *statsWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.n.Add(int64(n))
+	return n, err
+}
+
+// fold moves a connection's counted bytes into the rollups. s.mu must be
+// held.
+func (s *stats) fold(now time.Time, c *statsCounter) {
+	in, out := c.bytesIn.Swap(0), c.bytesOut.Swap(0)
+	if in == 0 && out == 0 {
+		return
+	}
+
+	s.record(now, c.group, func(b *statsBucket) {
+		b.BytesIn += in
+		b.BytesOut += out
+	})
+}
+
+// foldLive folds the bytes of every open connection. s.mu must be held.
+func (s *stats) foldLive() {
+	now := time.Now()
+	for c := range s.live {
+		s.fold(now, c)
+	}
+}
+
+// foldEvery folds the bytes of every open connection each interval,
+// forgetting closed connections once they've been folded after closing.
+func (s *stats) foldEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mu.Lock()
+		s.foldLive()
+		for c, closed := range s.live {
+			if closed {
+				delete(s.live, c)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *stats) query(label string, from, to time.Time) []statsRow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.foldLive()
+
+	rows := []statsRow{}
+	for t, groups := range s.rollups[label] {
+		if t.Before(from) || t.After(to) {
+			continue
+		}
+
+		row := statsRow{Time: t, Resolution: label, Groups: map[string]*statsBucket{}}
+		for g, b := range groups {
+			copied := *b
+			row.Groups[g] = &copied
+		}
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Time.Before(rows[j].Time)
+	})
+
+	return rows
+}
+
+func (s *stats) prune() {
+	for range time.Tick(time.Minute) {
+		expired := s.expire(time.Now().Add(-s.retention))
+
+		if s.spillPath != "" && len(expired) > 0 {
+			if err := s.spill(expired); err != nil {
+				log.Printf("error spilling stats: %v", err)
+			}
+		}
+	}
+}
+
+func (s *stats) expire(before time.Time) []statsRow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []statsRow
+	for label, buckets := range s.rollups {
+		for t, groups := range buckets {
+			if t.Add(statsResolutions[label]).After(before) {
+				continue
+			}
+
+			expired = append(expired, statsRow{Time: t, Resolution: label, Groups: groups})
+			delete(buckets, t)
+		}
+	}
+
+	return expired
+}
+
+// spill appends expired rows to the spill file as JSON lines.
+func (s *stats) spill(rows []statsRow) error {
+	f, err := os.OpenFile(s.spillPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening spill file: %w", err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, r := range rows {
+		if err = enc.Encode(r); err != nil {
+			return fmt.Errorf("writing spill file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (svr *server) handleGetStats(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetStats")
+	defer log.Println("[END] handleGetStats")
+
+	q := r.URL.Query()
+
+	res := q.Get("resolution")
+	if res == "" {
+		res = "1m"
+	}
+	if _, ok := statsResolutions[res]; !ok {
+		return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("invalid resolution %q, must be one of 1m, 5m or 1h", res))
+	}
+
+	to := time.Now()
+	from := to.Add(-time.Hour)
+
+	if v := q.Get("from"); v != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("parsing from: %w", err))
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return errhandler.Error(http.StatusUnprocessableEntity, fmt.Errorf("parsing to: %w", err))
+		}
+	}
+
+	return errhandler.SendJSON(w, svr.stats.query(res, from, to))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// tagPolicy applies to connections that identify themselves with a tag in
+// their preamble. Tagged connections are routed to Groups (whether or not
+// they're active) and limited to MaxConnections at a time.
+type tagPolicy struct {
+	Groups         []string `json:"groups,omitempty"`
+	MaxConnections int64    `json:"max_connections,omitempty"`
+}
+
+func (svr *server) handleGetTags(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleGetTags")
+	defer log.Println("[END] handleGetTags")
+
+	p, err := parsePage(r)
+	if err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	var names []string
+	for name := range svr.tags {
+		if p.matches(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	tags := map[string]tagPolicy{}
+	for _, name := range paginate(w, p, names) {
+		tags[name] = svr.tags[name]
+	}
+
+	return errhandler.SendJSON(w, tags)
+}
+
+func (svr *server) handleSetTag(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleSetTag")
+	defer log.Println("[END] handleSetTag")
+
+	tag := r.PathValue("tag")
+
+	var req tagPolicy
+	if err := errhandler.ParseJSON(r, &req); err != nil {
+		return errhandler.Error(http.StatusUnprocessableEntity, err)
+	}
+
+	log.Printf("[SET] tag: %q groups: %v max connections: %d", tag, req.Groups, req.MaxConnections)
+
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	svr.tags[tag] = req
+	return nil
+}
+
+func (svr *server) handleDeleteTag(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleDeleteTag")
+	defer log.Println("[END] handleDeleteTag")
+
+	svr.serversMu.Lock()
+	defer svr.serversMu.Unlock()
+
+	delete(svr.tags, r.PathValue("tag"))
+	return nil
+}
+
+func (svr *server) tagPolicy(tag string) (tagPolicy, bool) {
+	if tag == "" {
+		return tagPolicy{}, false
+	}
+
+	svr.serversMu.RLock()
+	defer svr.serversMu.RUnlock()
+
+	p, ok := svr.tags[tag]
+	return p, ok
+}
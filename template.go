@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Placeholders that can appear in a group's address template, filled from
+// the incoming connection.
+const (
+	placeholderTag      = "{tag}"
+	placeholderSNI      = "{sni}"
+	placeholderDatabase = "{database}"
+)
+
+// pgStartupMaxLength bounds how much of a pgwire startup message is buffered
+// while looking for the database name.
+const pgStartupMaxLength = 10000
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{[^}]*\}`)
+
+	// dnsLabel matches a single DNS label. Placeholder values have to be
+	// made of them, so clients can't steer the address (e.g. to another
+	// port) with characters like ":" or "/".
+	dnsLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+	errPeeked = errors.New("peeked")
+)
+
+func validateTemplate(template string) error {
+	for _, p := range placeholderPattern.FindAllString(template, -1) {
+		switch p {
+		case placeholderTag, placeholderSNI, placeholderDatabase:
+		default:
+			return fmt.Errorf("invalid placeholder %q in template, must be one of %s, %s or %s", p, placeholderTag, placeholderSNI, placeholderDatabase)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(template); err != nil {
+		return fmt.Errorf("invalid template %q: %w", template, err)
+	}
+
+	return nil
+}
+
+// expandTemplate fills a template's placeholders from the client connection,
+// peeking at the start of its stream where needed. Every placeholder used
+// must have a value.
+func expandTemplate(client net.Conn, template, tag string, limits peekLimits) (net.Conn, string, error) {
+	values := map[string]string{placeholderTag: tag}
+
+	if strings.Contains(template, placeholderSNI) {
+		var hello clientHello
+		client, hello = peekClientHello(client, limits)
+		values[placeholderSNI] = hello.serverName
+	}
+	if strings.Contains(template, placeholderDatabase) {
+		client, values[placeholderDatabase] = peekDatabase(client, limits)
+	}
+
+	var missing, invalid []string
+	addr := placeholderPattern.ReplaceAllStringFunc(template, func(p string) string {
+		switch v := values[p]; {
+		case v == "":
+			missing = append(missing, p)
+		case !validPlaceholderValue(p, v):
+			invalid = append(invalid, fmt.Sprintf("%s %q", p, v))
+		}
+		return values[p]
+	})
+
+	if len(missing) > 0 {
+		return client, "", fmt.Errorf("template %q needs %s but the client didn't provide it", template, strings.Join(missing, ", "))
+	}
+	if len(invalid) > 0 {
+		return client, "", fmt.Errorf("template %q can't be filled with values that aren't valid DNS names: %s", template, strings.Join(invalid, ", "))
+	}
+
+	return client, addr, nil
+}
+
+// validPlaceholderValue returns true if a value can be put in an address:
+// server names must be DNS names, and other values single DNS labels.
+func validPlaceholderValue(placeholder, value string) bool {
+	if placeholder != placeholderSNI {
+		return dnsLabel.MatchString(value)
+	}
+	return validDNSName(value)
+}
+
+// validDNSName returns true if name is made of dot-separated DNS labels.
+func validDNSName(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !dnsLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientHello is what dp can see of a TLS ClientHello without terminating
+// TLS: the server name and the ALPN protocols offered, in the client's order
+// of preference.
+type clientHello struct {
+	serverName string
+	protocols  []string
+}
+
+// peekClientHello returns a client's TLS ClientHello, replaying everything
+// read so the connection is passed through untouched. ClientHellos bigger
+// than the peek limit aren't read past it.
+func peekClientHello(client net.Conn, limits peekLimits) (net.Conn, clientHello) {
+	var buf bytes.Buffer
+	var hello clientHello
+
+	client.SetReadDeadline(time.Now().Add(limits.timeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	r := io.TeeReader(io.LimitReader(client, int64(limits.maxBytes)), &buf)
+	tls.Server(readOnlyConn{Conn: client, r: r}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = clientHello{serverName: info.ServerName, protocols: info.SupportedProtos}
+			return nil, errPeeked
+		},
+	}).Handshake()
+
+	return replayConn(client, buf.Bytes()), hello
+}
+
+// peekDatabase returns the database from an unencrypted pgwire startup
+// message, without consuming it. Startup messages bigger than the peek limit
+// aren't looked at.
+func peekDatabase(client net.Conn, limits peekLimits) (net.Conn, string) {
+	maxLength := min(limits.maxBytes, pgStartupMaxLength)
+	br := bufio.NewReaderSize(client, maxLength)
+	conn := &bufferedConn{Conn: client, r: br}
+
+	client.SetReadDeadline(time.Now().Add(limits.timeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	header, err := br.Peek(8)
+	if err != nil {
+		return conn, ""
+	}
+
+	length := int(binary.BigEndian.Uint32(header[0:4]))
+	if length < 8 || length > maxLength || binary.BigEndian.Uint32(header[4:8]) != pgProtocolVersion3 {
+		return conn, ""
+	}
+
+	msg, err := br.Peek(length)
+	if err != nil {
+		return conn, ""
+	}
+
+	params := bytes.Split(bytes.TrimRight(msg[8:], "\x00"), []byte{0})
+	for i := 0; i+1 < len(params); i += 2 {
+		if string(params[i]) == "database" {
+			return conn, string(params[i+1])
+		}
+	}
+
+	return conn, ""
+}
+
+// replayConn returns a connection that reads the given bytes before reading
+// from the connection itself.
+func replayConn(conn net.Conn, read []byte) net.Conn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(bytes.NewReader(read), conn))}
+}
+
+// readOnlyConn lets the TLS package parse a ClientHello without being able to
+// write anything back to the client.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
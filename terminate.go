@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/errhandler"
+)
+
+// pendingTermination holds a termination that's been scheduled but not yet
+// fired, giving monitoring a chance to record a change before the connection
+// storm and operators a window to abort it.
+type pendingTermination struct {
+	delay time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// terminate closes all existing connections, after the configured delay.
+func (svr *server) terminate() {
+	svr.terminateAfter(svr.pendingTermination.delay)
+}
+
+// terminateAfter lets existing connections finish for up to delay, then
+// closes those still open. A later change replaces the pending termination.
+func (svr *server) terminateAfter(delay time.Duration) {
+	p := svr.pendingTermination
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	if delay == 0 {
+		svr.terminateNow()
+		return
+	}
+
+	log.Printf("terminating connections in %s", delay)
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		// A timer that fired as it was being replaced mustn't clear its
+		// replacement, or the replacement couldn't be aborted.
+		p.mu.Lock()
+		if p.timer == t {
+			p.timer = nil
+		}
+		p.mu.Unlock()
+
+		svr.terminateNow()
+	})
+	p.timer = t
+}
+
+func (svr *server) terminateNow() {
+	svr.events.publish(event{Kind: eventTerminate})
+}
+
+func (svr *server) handleAbortTermination(w http.ResponseWriter, r *http.Request) error {
+	log.Println("[START] handleAbortTermination")
+	defer log.Println("[END] handleAbortTermination")
+
+	p := svr.pendingTermination
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.timer == nil || !p.timer.Stop() {
+		return errhandler.Error(http.StatusNotFound, errors.New("no pending termination"))
+	}
+	p.timer = nil
+
+	log.Printf("aborted pending termination")
+	return nil
+}
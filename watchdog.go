@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progress tracks whether a connection's server is keeping up with its
+// client, so connections stuck on a hung server can be caught before the
+// client's own timeouts notice.
+type progress struct {
+	// awaiting holds when the client sent data that the server hasn't
+	// responded to yet, in unix nanoseconds, or zero if there's none.
+	awaiting atomic.Int64
+}
+
+// stuckFor returns how long the server has gone without responding to data
+// the client has sent, or zero if it's not waiting on the server.
+func (p *progress) stuckFor() time.Duration {
+	since := p.awaiting.Load()
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// toServer wraps the writer for data sent by the client, marking the server
+// as having something to respond to.
+func (p *progress) toServer(w io.Writer) io.Writer {
+	return &progressWriter{w: w, mark: func() {
+		p.awaiting.CompareAndSwap(0, time.Now().UnixNano())
+	}}
+}
+
+// toClient wraps the writer for data sent by the server, which counts as it
+// making progress.
+func (p *progress) toClient(w io.Writer) io.Writer {
+	return &progressWriter{w: w, mark: func() {
+		p.awaiting.Store(0)
+	}}
+}
+
+type progressWriter struct {
+	w    io.Writer
+	mark func()
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.mark()
+	return pw.w.Write(p)
+}
+
+func (pw *progressWriter) flush() {
+	flushWriter(pw.w)
+}
+
+// watchdogInterval returns how often to check connections for being stuck
+// for longer than after.
+func watchdogInterval(after time.Duration) time.Duration {
+	return max(after/4, time.Millisecond*100)
+}